@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"time"
+	"url-shortener/url_data"
+)
+
+// actions
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge" // deleted for good
+)
+
+// audit event of a short link, stored in its own collection
+// omitempty is required for db filters
+type Event struct {
+	ID        string            `json:"_id,omitempty" bson:"_id,omitempty"`
+	ShortCode string            `json:"shortCode" bson:"shortCode,omitempty"`
+	Domain    string            `json:"domain,omitempty" bson:"domain,omitempty"` // empty for the default domain
+	Workspace string            `json:"-" bson:"workspace,omitempty"`
+	Action    string            `json:"action" bson:"action,omitempty"`
+	Actor     string            `json:"actor" bson:"actor,omitempty"` // who made the change
+	At        time.Time         `json:"at" bson:"at,omitempty"`
+	Old       *url_data.URLData `json:"old,omitempty" bson:"old,omitempty"` // nil for create
+	New       *url_data.URLData `json:"new,omitempty" bson:"new,omitempty"` // nil for delete
+}
+
+// filter of events of a short code on a domain, and in a workspace if set
+// events of the default domain have no domain field, matched by null
+type HistoryFilter struct {
+	ShortCode string  `bson:"shortCode"`
+	Domain    *string `bson:"domain"` // nil for the default domain
+	Workspace string  `bson:"workspace,omitempty"`
+}
+
+// filter of history of short code on domain, empty domain is the default one
+func HistoryOf(domain string, workspace string, short_code string) HistoryFilter {
+	filter := HistoryFilter{ShortCode: short_code, Workspace: workspace}
+	if domain != "" {
+		filter.Domain = &domain
+	}
+	return filter
+}
+
+// create event of action on short code
+// old and new are copied without password hashes, so that callers may keep modifying them
+func NewEvent(short_code string, action string, actor string, old *url_data.URLData, new *url_data.URLData) Event {
+	event := Event{
+		ShortCode: short_code,
+		Action:    action,
+		Actor:     actor,
+		At:        time.Now().UTC(),
+	}
+	if old != nil {
+		event.Old = old.Snapshot()
+		event.Domain = old.Domain
+		event.Workspace = old.Workspace
+	}
+	if new != nil {
+		event.New = new.Snapshot()
+		event.Domain = new.Domain
+		event.Workspace = new.Workspace
+	}
+	return event
+}
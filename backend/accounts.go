@@ -0,0 +1,297 @@
+package backend
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/workspace"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookie = "session"
+const csrfHeader = "X-CSRF-Token"
+const maxLoginFailures int = 5
+const loginLockout = 15 * time.Minute
+
+var authRoutes = []string{"/auth/register", "/auth/login", "/auth/logout", "/auth/session"}
+
+var backend_users DB
+var backend_sessions DB
+var session_ttl = 7 * 24 * time.Hour
+var open_registration bool
+var registration_quotas workspace.Quotas
+
+// compared against when the user doesn't exist, so that unknown names take as long as wrong passwords
+var dummy_hash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+var login_lockout = &lockout{
+	entries: make(map[string]*lockoutEntry),
+	max:     maxLoginFailures,
+	period:  loginLockout,
+}
+
+// sets collections of user accounts and their sessions, which turns web login on
+// needs workspaces. should be called before Start()
+func SetAccounts(users DB, sessions DB, ttl time.Duration) {
+	backend_users = users
+	backend_sessions = sessions
+	session_ttl = ttl
+}
+
+// allows anyone to register, each account gets a workspace of its own with quotas
+// otherwise accounts are added by members of workspaces. should be called before Start()
+func SetRegistration(open bool, quotas workspace.Quotas) {
+	open_registration = open
+	registration_quotas = quotas
+}
+
+// login and registration request
+type credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// helpers
+
+func requireAccounts() {
+	requireWorkspaces()
+	if backend_users == nil {
+		panic(httpErr{
+			code:  http.StatusNotImplemented,
+			descr: "accounts are not configured"}) //501
+	}
+}
+
+// credentials from json body
+// only json is accepted, which cross-site forms can't send (login csrf)
+func credentialsOf(r *http.Request) (workspace.User, string) {
+	if media, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); media != "application/json" {
+		panic(httpErr{
+			code:  http.StatusUnsupportedMediaType,
+			descr: "expected application/json"}) //415
+	}
+	c := credentials{}
+	if err := json.Unmarshal(readBody(r), &c); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: fmt.Sprintf("Error processing request: %v", err)}) //400
+	}
+	return workspace.User{Name: c.Name}, c.Password
+}
+
+// create account, fails with 400 on invalid credentials and 409 on taken names
+func createUser(r *http.Request, user workspace.User, password string) workspace.User {
+	if err := user.Normalize(password); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: err.Error()}) //400
+	}
+	user.PasswordHash = hashPassword(password)
+	user.CreatedAt = time.Now().UTC()
+	// unique index catches taken names
+	var err error
+	user.ID, err = backend_users.InsertOne(r.Context(), user)
+	if err == db_interface.ErrDuplicateKey {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: fmt.Sprintf("user %q already exists", user.Name)}) //409
+	}
+	handleDBErrors(err)
+	slog.InfoContext(r.Context(), "user created", "workspace", user.Workspace, "user", user.Name)
+	return user
+}
+
+// token of session cookie
+func sessionTokenOf(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   schemeOf(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
+
+// session of request cookie, nil if there is none or it expired
+func findSession(r *http.Request) *workspace.Session {
+	token := sessionTokenOf(r)
+	if token == "" || backend_sessions == nil {
+		return nil
+	}
+	session := workspace.Session{}
+	err := backend_sessions.FindOne(r.Context(), workspace.Session{Hash: workspace.HashToken(token)}, &session)
+	if err == db_interface.ErrNoDocuments {
+		return nil
+	}
+	handleDBErrors(err)
+	if time.Now().After(session.ExpiresAt) {
+		deleteSession(r.Context(), session)
+		return nil
+	}
+	return &session
+}
+
+func deleteSession(ctx context.Context, session workspace.Session) {
+	err := backend_sessions.DeleteOne(ctx, workspace.Session{Hash: session.Hash})
+	if err != nil && err != db_interface.ErrNoDocuments {
+		slog.ErrorContext(ctx, "couldn't delete session", "user", session.User, "error", err)
+	}
+}
+
+// changes made within a session need its csrf token in the X-CSRF-Token header
+func checkCSRF(r *http.Request, session workspace.Session) {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(session.CSRFToken)) != 1 {
+		panic(httpErr{
+			code:  http.StatusForbidden,
+			descr: "invalid csrf token"}) //403
+	}
+}
+
+// sign user in, replacing the session of the request if any
+func startSession(w http.ResponseWriter, r *http.Request, user workspace.User) workspace.Session {
+	if old := findSession(r); old != nil {
+		deleteSession(r.Context(), *old)
+	}
+	session, token, err := workspace.NewSession(user, session_ttl)
+	if err != nil {
+		panic(fmt.Sprintf("Error creating session:\n%v", err))
+	}
+	session.ID, err = backend_sessions.InsertOne(r.Context(), session)
+	handleDBErrors(err)
+	setSessionCookie(w, r, token, session.ExpiresAt)
+	slog.InfoContext(r.Context(), "user signed in", "workspace", user.Workspace, "user", user.Name)
+	return session
+}
+
+// create account along with a workspace of its own and sign it in
+func register(w http.ResponseWriter, r *http.Request) {
+	if !open_registration {
+		panic(httpErr{
+			code:  http.StatusForbidden,
+			descr: "registration is closed"}) //403
+	}
+	user, password := credentialsOf(r)
+	if err := user.Normalize(password); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: err.Error()}) //400
+	}
+	err := backend_users.FindOne(r.Context(), workspace.User{Name: user.Name}, &workspace.User{})
+	if err == nil {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: fmt.Sprintf("user %q already exists", user.Name)}) //409
+	} else if err != db_interface.ErrNoDocuments {
+		handleDBErrors(err)
+	}
+	// unique index catches taken workspace names
+	ws := workspace.Workspace{Name: user.Name, Quotas: registration_quotas, CreatedAt: time.Now().UTC()}
+	ws.ID, err = backend_workspaces.InsertOne(r.Context(), ws)
+	if err == db_interface.ErrDuplicateKey {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: fmt.Sprintf("workspace %q already exists", ws.Name)}) //409
+	}
+	handleDBErrors(err)
+	slog.InfoContext(r.Context(), "workspace created", "workspace", ws.Name)
+	user.Workspace = ws.Name
+	user = func() workspace.User {
+		// don't leave the workspace behind without its user
+		defer func() {
+			if e := recover(); e != nil {
+				if err := backend_workspaces.DeleteOne(context.WithoutCancel(r.Context()), workspace.Workspace{Name: ws.Name}); err != nil {
+					slog.ErrorContext(r.Context(), "couldn't remove workspace of failed registration", "workspace", ws.Name, "error", err)
+				}
+				panic(e)
+			}
+		}()
+		return createUser(r, user, password)
+	}()
+	sendJsonResponse(w, r, http.StatusCreated, startSession(w, r, user)) //201
+}
+
+// sign in with name and password, locks clients out after repeated failures
+func login(w http.ResponseWriter, r *http.Request) {
+	user, password := credentialsOf(r)
+	key := user.Name + "|" + clientIP(r)
+	if remaining := login_lockout.locked(key); remaining > 0 {
+		panic(httpErr{
+			code:  http.StatusTooManyRequests,
+			descr: fmt.Sprintf("too many failed attempts, try again in %v", remaining)}) //429
+	}
+	hash := dummy_hash
+	if user.Name != "" {
+		err := backend_users.FindOne(r.Context(), workspace.User{Name: user.Name}, &user)
+		if err == nil {
+			hash = []byte(user.PasswordHash)
+		} else if err != db_interface.ErrNoDocuments {
+			handleDBErrors(err)
+		}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || user.PasswordHash == "" {
+		login_lockout.fail(key)
+		panic(httpErr{
+			code:  http.StatusUnauthorized,
+			descr: "invalid user name or password"}) //401
+	}
+	login_lockout.reset(key)
+	sendJsonResponse(w, r, http.StatusOK, startSession(w, r, user))
+}
+
+// sign out, the session cookie is cleared in any case
+func logout(w http.ResponseWriter, r *http.Request) {
+	if session := findSession(r); session != nil {
+		checkCSRF(r, *session)
+		deleteSession(r.Context(), *session)
+		slog.InfoContext(r.Context(), "user signed out", "workspace", session.Workspace, "user", session.User)
+	}
+	setSessionCookie(w, r, "", time.Time{})
+	w.WriteHeader(http.StatusNoContent) //204
+}
+
+// handle /auth requests
+func auth(w http.ResponseWriter, r *http.Request) {
+	defer recover_hdl(w, r)
+	setCachePolicy(w, r)
+	requireAccounts()
+	switch {
+	case r.URL.Path == "/auth/register" && r.Method == "POST":
+		register(w, r)
+	case r.URL.Path == "/auth/login" && r.Method == "POST":
+		login(w, r)
+	case r.URL.Path == "/auth/logout" && r.Method == "POST":
+		logout(w, r)
+	case r.URL.Path == "/auth/session" && r.Method == "GET":
+		session := findSession(r)
+		if session == nil {
+			panic(httpErr{
+				code:  http.StatusUnauthorized,
+				descr: "not signed in"}) //401
+		}
+		sendJsonResponse(w, r, http.StatusOK, *session)
+	case slices.Contains(authRoutes, r.URL.Path):
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+	}
+}
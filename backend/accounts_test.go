@@ -0,0 +1,277 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/workspace"
+)
+
+// mock user collection
+
+type userCollectionMock struct {
+	unsupportedCollection
+	users []workspace.User
+}
+
+func (collection *userCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(workspace.User)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	for _, user := range collection.users {
+		if user.Name == t.Name {
+			return "", db_interface.ErrDuplicateKey
+		}
+	}
+	t.ID = fmt.Sprintf("%d", len(collection.users))
+	collection.users = append(collection.users, t)
+	return t.ID, nil
+}
+
+func (collection *userCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	f, ok := filter.(workspace.User)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	r, ok := result.(*workspace.User)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	for _, user := range collection.users {
+		if f.Name == "" || f.Name == user.Name {
+			*r = user
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+// mock user collection failing on inserts
+
+type brokenUserCollectionMock struct {
+	userCollectionMock
+}
+
+func (collection *brokenUserCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	return "", fmt.Errorf("connection lost")
+}
+
+// mock session collection
+
+type sessionCollectionMock struct {
+	unsupportedCollection
+	sessions []workspace.Session
+}
+
+func (collection *sessionCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(workspace.Session)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	t.ID = fmt.Sprintf("%d", len(collection.sessions))
+	collection.sessions = append(collection.sessions, t)
+	return t.ID, nil
+}
+
+func (collection *sessionCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	f, ok := filter.(workspace.Session)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	r, ok := result.(*workspace.Session)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	for _, session := range collection.sessions {
+		if session.Hash == f.Hash {
+			*r = session
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func (collection *sessionCollectionMock) DeleteOne(ctx context.Context, filter any) error {
+	f, ok := filter.(workspace.Session)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	for i, session := range collection.sessions {
+		if session.Hash == f.Hash {
+			collection.sessions = slices.Delete(collection.sessions, i, i+1)
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func TestAccounts(t *testing.T) {
+	SetWorkspaces(&workspaceCollectionMock{}, &keyCollectionMock{}, "admin-secret")
+	defer SetWorkspaces(nil, nil, "")
+	SetAccounts(&userCollectionMock{}, &sessionCollectionMock{}, time.Hour)
+	defer SetAccounts(nil, nil, time.Hour)
+	SetRegistration(true, workspace.Quotas{MaxLinks: 5})
+	defer SetRegistration(false, workspace.Quotas{})
+	mock_db.data = mock_db.data[:0] //clear data
+	setupMocks()
+	// browser requests, with session cookie and csrf token if any
+	request := func(method, path string, cookie *http.Cookie, csrf string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		if csrf != "" {
+			r.Header.Set(csrfHeader, csrf)
+		}
+		switch {
+		case strings.HasPrefix(path, "/shorten"):
+			shorten(w, r)
+		case strings.HasPrefix(path, "/auth"):
+			auth(w, r)
+		default:
+			workspaces(w, r)
+		}
+		return w
+	}
+	signIn := func(w *httptest.ResponseRecorder, code int) (*http.Cookie, workspace.Session) {
+		t.Helper()
+		session := workspace.Session{}
+		if w.Code != code || json.Unmarshal(w.Body.Bytes(), &session) != nil || len(w.Result().Cookies()) != 1 {
+			t.Fatalf("invalid response %v %s", w.Code, w.Body.String())
+		}
+		cookie := w.Result().Cookies()[0]
+		if cookie.Name != sessionCookie || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode ||
+			strings.Contains(w.Body.String(), cookie.Value) {
+			t.Errorf("invalid cookie %v", cookie)
+		}
+		return cookie, session
+	}
+
+	// registration
+	w := httptest.NewRecorder()
+	auth(w, httptest.NewRequest("POST", "/auth/register", strings.NewReader(`name=alice&password=correct+horse`)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	cookie, session := signIn(request("POST", "/auth/register", nil, "", `{"name": "alice", "password": "correct horse"}`), http.StatusCreated)
+	if session.User != "alice" || session.Workspace != "alice" || session.CSRFToken == "" {
+		t.Errorf("invalid session %+v", session)
+	}
+	for body, code := range map[string]int{
+		`{"name": "alice", "password": "correct horse"}`: http.StatusConflict,
+		`{"name": "bob", "password": "short"}`:           http.StatusBadRequest,
+		`{"name": "Bob", "password": "correct horse"}`:   http.StatusBadRequest,
+	} {
+		if w := request("POST", "/auth/register", nil, "", body); w.Code != code {
+			t.Errorf("invalid response code %v for %s", w.Code, body)
+		}
+	}
+	if w := request("GET", "/auth/session", cookie, "", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), session.CSRFToken) {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/auth/session", nil, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// links of the session, changes need the csrf token
+	if w := request("POST", "/shorten", cookie, "", `{"url": "http://someurl.com"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("POST", "/shorten", cookie, "forged", `{"url": "http://someurl.com"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("POST", "/shorten", cookie, session.CSRFToken, `{"url": "http://someurl.com"}`); w.Code != http.StatusCreated {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if len(mock_db.data) != 1 || mock_db.data[0].Workspace != "alice" || mock_db.data[0].Owner != "alice" {
+		t.Errorf("invalid records %+v", mock_db.data)
+	}
+	if w := request("GET", "/shorten/list", cookie, "", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "someurl") {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	// the admin adds accounts to workspaces
+	if w := request("POST", "/workspaces/alice/users", cookie, session.CSRFToken, `{"name": "bob", "password": "battery staple"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/workspaces/alice/users", strings.NewReader(`{"name": "bob", "password": "battery staple"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer admin-secret")
+	workspaces(w, r)
+	if w.Code != http.StatusCreated || strings.Contains(w.Body.String(), "password") || !strings.Contains(w.Body.String(), `"workspace":"alice"`) {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+
+	// login
+	for body, code := range map[string]int{
+		`{"name": "bob", "password": "wrong password"}`:   http.StatusUnauthorized,
+		`{"name": "carol", "password": "battery staple"}`: http.StatusUnauthorized,
+		`{"password": "battery staple"}`:                  http.StatusUnauthorized,
+	} {
+		if w := request("POST", "/auth/login", nil, "", body); w.Code != code {
+			t.Errorf("invalid response code %v for %s", w.Code, body)
+		}
+	}
+	bob_cookie, bob := signIn(request("POST", "/auth/login", nil, "", `{"name": "bob", "password": "battery staple"}`), http.StatusOK)
+	if bob.User != "bob" || bob.Workspace != "alice" {
+		t.Errorf("invalid session %+v", bob)
+	}
+	if w := request("GET", "/shorten/list", bob_cookie, "", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "someurl") {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+
+	// logout
+	if w := request("POST", "/auth/logout", cookie, "", ""); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	w = request("POST", "/auth/logout", cookie, session.CSRFToken, "")
+	if w.Code != http.StatusNoContent || len(w.Result().Cookies()) != 1 || w.Result().Cookies()[0].MaxAge >= 0 {
+		t.Errorf("invalid response %v %v", w.Code, w.Result().Cookies())
+	}
+	if w := request("GET", "/shorten/list", cookie, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// lockout after repeated failures
+	for i := 0; i < maxLoginFailures; i++ {
+		request("POST", "/auth/login", nil, "", `{"name": "alice", "password": "wrong password"}`)
+	}
+	if w := request("POST", "/auth/login", nil, "", `{"name": "alice", "password": "correct horse"}`); w.Code != http.StatusTooManyRequests {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	login_lockout.reset("alice|192.0.2.1")
+
+	SetRegistration(false, workspace.Quotas{})
+	if w := request("POST", "/auth/register", nil, "", `{"name": "dave", "password": "correct horse"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	backend_clicks.Flush(context.Background())
+}
+
+func TestFailedRegistration(t *testing.T) {
+	workspaces := &workspaceCollectionMock{}
+	SetWorkspaces(workspaces, &keyCollectionMock{}, "admin-secret")
+	defer SetWorkspaces(nil, nil, "")
+	SetAccounts(&brokenUserCollectionMock{}, &sessionCollectionMock{}, time.Hour)
+	defer SetAccounts(nil, nil, time.Hour)
+	SetRegistration(true, workspace.Quotas{})
+	defer SetRegistration(false, workspace.Quotas{})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/auth/register", strings.NewReader(`{"name": "alice", "password": "correct horse"}`))
+	r.Header.Set("Content-Type", "application/json")
+	auth(w, r)
+	// workspace of the user which couldn't be created is removed again
+	if w.Code != http.StatusInternalServerError || len(workspaces.workspaces) != 0 {
+		t.Errorf("invalid response %v %s, workspaces %+v", w.Code, w.Body.String(), workspaces.workspaces)
+	}
+}
@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"url-shortener/db_interface"
+	"url-shortener/url_data"
+)
+
+// custom short codes, '+' is left out since it requests a preview
+var aliasFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// first path segments of the api, which links can't shadow
+var reservedAliases = []string{"shorten", "metrics", "healthz", "readyz", "campaigns", "workspaces", "workspace", "me", "auth"}
+
+// helpers
+
+// check custom short code of new record on its domain
+// fails with 400 on invalid or reserved codes and 409 on taken ones
+func checkAlias(r *http.Request, record *URLData) {
+	code := record.ShortCode
+	if !aliasFormat.MatchString(code) {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: "short code must be 3-64 letters, digits, '_' or '-'"}) //400
+	}
+	if slices.Contains(reservedAliases, strings.ToLower(code)) || isStaticFile(code) {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("short code %q is reserved", code)}) //400
+	}
+	err := backend_db.FindOne(r.Context(), url_data.ByCode(record.Domain, code), &URLData{})
+	if err == nil || (err == db_interface.ErrNoDocuments && reserve_deleted_codes && codeWasUsed(r.Context(), code)) {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: fmt.Sprintf("short code %q is taken", code)}) //409
+	} else if err != db_interface.ErrNoDocuments {
+		handleDBErrors(err)
+	}
+}
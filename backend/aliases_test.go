@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAliases(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	defer func() { mock_db.data = mock_db.data[:0] }()
+	for body, code := range map[string]int{
+		`{"url": "http://someurl.com/1", "shortCode": "ab"}`:      http.StatusBadRequest,
+		`{"url": "http://someurl.com/1", "shortCode": "a/b/c"}`:   http.StatusBadRequest,
+		`{"url": "http://someurl.com/1", "shortCode": "a+b"}`:     http.StatusBadRequest,
+		`{"url": "http://someurl.com/1", "shortCode": "Shorten"}`: http.StatusBadRequest,
+		`{"url": "http://someurl.com/1", "shortCode": "promo"}`:   http.StatusCreated,
+	} {
+		if w := testHTTP("POST", "/shorten", body); w.Code != code {
+			t.Errorf("invalid response %v %s for %s", w.Code, w.Body.String(), body)
+		}
+	}
+	if len(mock_db.data) != 1 || mock_db.data[0].ShortCode != "promo" || !mock_db.data[0].Alias {
+		t.Fatalf("invalid records %+v", mock_db.data)
+	}
+	// taken codes, aliases aren't shared by equal requests either
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl.com/1", "shortCode": "promo"}`); w.Code != http.StatusConflict {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl.com/1", "shortCode": "promo2"}`); w.Code != http.StatusCreated {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// aliases survive updates
+	if w := testHTTP("PUT", "/shorten/promo", `{"url": "http://someurl.com/2"}`); w.Code != http.StatusOK || !mock_db.data[0].Alias {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	root(http.NotFoundHandler())(w, httptest.NewRequest("GET", "/promo", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://someurl.com/2" {
+		t.Errorf("invalid response %v %s", w.Code, w.Header().Get("Location"))
+	}
+	backend_clicks.Flush(context.Background())
+}
@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"url-shortener/audit"
+)
+
+const historyMaxLen int = 100
+
+var backend_audit DB
+
+// sets collection storing audit events. should be called before Start()
+func SetAuditCollection(collection DB) {
+	backend_audit = collection
+}
+
+// helpers
+
+// who made the change, user of the api key if any
+func actorOf(r *http.Request) string {
+	if t := tenantOf(r); t != nil {
+		if t.key.User != "" {
+			return t.key.User
+		}
+		return t.key.Hint
+	}
+	return clientIP(r)
+}
+
+// store audit event of short code
+// failures are only logged, since the change itself already happened
+func recordEvent(ctx context.Context, actor string, short_code string, action string, old *URLData, new *URLData) {
+	if backend_audit == nil {
+		return
+	}
+	event := audit.NewEvent(short_code, action, actor, old, new)
+	if _, err := backend_audit.InsertOne(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "couldn't record audit event", "code", short_code, "action", action, "error", err)
+	}
+}
+
+// get latest history of short code, oldest first
+func getHistory(short_code string, w http.ResponseWriter, r *http.Request) {
+	if backend_audit == nil {
+		panic(httpErr{
+			code:  http.StatusNotImplemented,
+			descr: "audit trail is not configured"})
+	}
+	events := make([]audit.Event, 0, historyMaxLen)
+	filter := audit.HistoryOf(apiDomainOf(r), workspaceOf(r), short_code)
+	handleDBErrors(backend_audit.FindSorted(r.Context(), filter, "-at", 0, historyMaxLen, &events))
+	if len(events) == 0 {
+		panic(httpErr{
+			code:  http.StatusNotFound,
+			descr: "no history found"})
+	}
+	slices.Reverse(events)
+	// password isn't checked here
+	for _, event := range events {
+		for _, snapshot := range []*URLData{event.Old, event.New} {
+			if snapshot != nil {
+				snapshot.Redact()
+			}
+		}
+	}
+	sendJsonResponse(w, r, http.StatusOK, events) // 200
+}
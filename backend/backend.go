@@ -5,11 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
+	"url-shortener/audit"
+	"url-shortener/clicks"
 	"url-shortener/db_interface"
+	"url-shortener/logging"
+	"url-shortener/metrics"
+	"url-shortener/tracing"
 	"url-shortener/url_data"
 	"url-shortener/url_generator"
 )
@@ -19,9 +27,33 @@ type DB = db_interface.IDBCollection
 
 const shortURLLen int = 6
 const listMaxLen int = 10
+const maxGenAttempts int = 5
 
 var backend_db DB
 var backend_server *http.Server
+var backend_pinger db_interface.IDBPinger
+var shutting_down atomic.Bool
+var shutdown_delay time.Duration
+var backend_clicks *clicks.Aggregator
+var click_flush_interval = time.Second
+var click_flush_threshold = 1000
+
+// sets db pinger used by readiness probe. should be called before Start()
+func SetPinger(pinger db_interface.IDBPinger) {
+	backend_pinger = pinger
+}
+
+// sets for how long readiness fails before the server is shut down
+func SetShutdownDelay(delay time.Duration) {
+	shutdown_delay = delay
+}
+
+// sets how often (and after how many clicks) counted clicks are written to the db
+// should be called before Start()
+func SetClickFlush(interval time.Duration, threshold int) {
+	click_flush_interval = interval
+	click_flush_threshold = threshold
+}
 
 // helpers
 func tokenizePath(path string) []string {
@@ -29,6 +61,67 @@ func tokenizePath(path string) []string {
 	return strings.Split(path, "/")
 }
 
+// map request to a low-cardinality route label
+func routeOf(r *http.Request) string {
+	tokens := tokenizePath(r.URL.Path)
+	if r.URL.Path == "/me/usage" || slices.Contains(authRoutes, r.URL.Path) {
+		return r.URL.Path
+	}
+	if tokens[0] == "me" || tokens[0] == "auth" {
+		return "other"
+	}
+	if tokens[0] == "workspaces" || tokens[0] == "workspace" {
+		switch {
+		case len(tokens) == 1:
+			return "/" + tokens[0]
+		case tokens[0] == "workspaces" && len(tokens) == 3 && (tokens[2] == "keys" || tokens[2] == "users"):
+			return "/workspaces/{name}/" + tokens[2]
+		case tokens[0] == "workspace" && len(tokens) == 2 && tokens[1] == "keys":
+			return "/workspace/keys"
+		case tokens[0] == "workspace" && len(tokens) == 3 && tokens[1] == "keys":
+			return "/workspace/keys/{id}"
+		}
+		return "other"
+	}
+	if tokens[0] == "campaigns" {
+		switch {
+		case len(tokens) == 1:
+			return "/campaigns"
+		case len(tokens) == 2:
+			return "/campaigns/{name}"
+		case len(tokens) == 3 && tokens[2] == "stats":
+			return "/campaigns/{name}/stats"
+		}
+		return "other"
+	}
+	if tokens[0] != "shorten" {
+		switch {
+		case tokens[0] == "" || isStaticFile(r.URL.Path):
+			return "/"
+		case len(tokens) > 1:
+			return "/{code}/{path}"
+		case tokens[0] == "metrics", tokens[0] == "healthz", tokens[0] == "readyz":
+			return "/" + tokens[0]
+		}
+		return "/{code}"
+	}
+	switch len(tokens) {
+	case 1:
+		return "/shorten"
+	case 2:
+		if tokens[1] == "list" || tokens[1] == "search" {
+			return "/shorten/" + tokens[1]
+		}
+		return "/shorten/{code}"
+	case 3:
+		switch tokens[2] {
+		case "stats", "qr", "sign", "history", "restore":
+			return "/shorten/{code}/" + tokens[2]
+		}
+	}
+	return "other"
+}
+
 func readBody(r *http.Request) []byte {
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -41,7 +134,7 @@ func readBody(r *http.Request) []byte {
 func recordFromBody(r *http.Request) URLData {
 	// read body
 	body := readBody(r)
-	log.Printf("[DEBUG] Request %s", string(body))
+	slog.DebugContext(r.Context(), "request body", "body", logging.RedactJSON(body))
 	record := URLData{}
 	// convert body to json
 	err := json.Unmarshal(body, &record)
@@ -51,21 +144,21 @@ func recordFromBody(r *http.Request) URLData {
 	return record
 }
 
-func sendJsonResponse(w http.ResponseWriter, status int, record any) {
-	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+// successful GET responses are tagged (unless the handler set an ETag) and may be answered with 304
+func sendJsonResponse(w http.ResponseWriter, r *http.Request, status int, record any) {
 	var jsonData []byte
 	var err error
 	switch j := record.(type) {
 	case URLData:
+		presentRecord(r, &j)
 		jsonData, err = json.Marshal(&j)
 	case []URLData:
+		for i := range j {
+			presentRecord(r, &j[i])
+		}
 		jsonData, err = json.Marshal(&j)
 	default:
-		panic(httpErr{
-			code:  http.StatusInternalServerError,
-			descr: "invalid data type",
-		})
+		jsonData, err = json.Marshal(j)
 	}
 	if err != nil {
 		panic(httpErr{
@@ -73,8 +166,19 @@ func sendJsonResponse(w http.ResponseWriter, status int, record any) {
 			descr: fmt.Sprintf("error marshaling data: %v", err),
 		})
 	}
+	if status == http.StatusOK && r.Method == "GET" {
+		if w.Header().Get("ETag") == "" {
+			w.Header().Set("ETag", contentETag(jsonData))
+		}
+		if notModified(r, w.Header()) {
+			writeNotModified(w)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
 	w.Write(jsonData)
-	log.Printf("[DEBUG] Response %s", jsonData)
+	slog.DebugContext(r.Context(), "response body", "body", logging.RedactJSON(jsonData))
 }
 
 func handleDBErrors(err error) {
@@ -85,6 +189,10 @@ func handleDBErrors(err error) {
 		panic(httpErr{
 			code:  http.StatusNotFound,
 			descr: err.Error()})
+	case db_interface.ErrDuplicateKey:
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: err.Error()})
 	default:
 		panic(httpErr{
 			code:  http.StatusInternalServerError,
@@ -92,64 +200,160 @@ func handleDBErrors(err error) {
 	}
 }
 
+// validate and complete user input of record
+func prepareRecord(r *http.Request, record *URLData) {
+	normalizeLabels(record)
+	checkPassthrough(record)
+	checkRules(record)
+	checkVariants(record)
+	applyCampaign(r, record)
+}
+
+// find record by short code on domain, deleted records are gone
+func findRecord(r *http.Request, domain string, short_code string) URLData {
+	record := URLData{}
+	handleDBErrors(backend_db.FindOne(r.Context(), url_data.ByCode(domain, short_code), &record))
+	checkOwner(r, record)
+	if record.Deleted {
+		panic(httpErr{
+			code:  http.StatusGone,
+			descr: "link was deleted"})
+	}
+	return record
+}
+
+// generate a short code which isn't taken yet
+func generateShortCode(r *http.Request, domain string) string {
+	for attempt := 0; attempt < maxGenAttempts; attempt++ {
+		code := url_generator.GenerateShortURL(shortURLLen)
+		err := backend_db.FindOne(r.Context(), url_data.ByCode(domain, code), &URLData{})
+		if err == db_interface.ErrNoDocuments && !(reserve_deleted_codes && codeWasUsed(r.Context(), code)) {
+			return code
+		}
+		handleDBErrors(err)
+		slog.DebugContext(r.Context(), "short code is taken, retrying", "code", code)
+		metrics.IncCollisionRetries()
+	}
+	panic(httpErr{
+		code:  http.StatusInternalServerError,
+		descr: "unable to generate unique short code"})
+}
+
 // register new url
 func handlePOST(w http.ResponseWriter, r *http.Request) {
 
+	tokens := tokenizePath(r.URL.Path)
+	if len(tokens) == 3 {
+		switch tokens[2] {
+		case "sign":
+			signLink(tokens[1], w, r)
+		case "restore":
+			restoreRecord(tokens[1], w, r)
+		default:
+			httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		}
+		return
+	}
 	switch r.URL.Path {
 	case "/shorten", "/shorten/":
 		record := recordFromBody(r)
+		record.Version = 0 // assigned by the server
+		if record.Domain != "" {
+			record.Domain = checkDomain(record.Domain)
+		} else {
+			record.Domain = apiDomainOf(r)
+		}
+		checkDomainOwner(r, record.Domain)
+		record.Workspace = workspaceOf(r)
+		if t := tenantOf(r); t != nil {
+			record.Owner = t.key.User
+		}
+		record.Alias = record.ShortCode != ""
+		if record.Alias {
+			checkAlias(r, &record)
+		}
+		prepareRecord(r, &record)
 		// check if such record already exists
-		// use parsed record as both filter and result
-		log.Printf("[DEBUG] Looking for record in db...")
-		err := backend_db.FindOne(record, &record)
-		if err == nil {
-			log.Printf("[DEBUG] Record already exists")
-			sendJsonResponse(w, http.StatusOK, record) //200
-			return
-		} else if err != db_interface.ErrNoDocuments {
-			handleDBErrors(err)
+		// protected links, aliases and links with options are never shared
+		if record.Password == "" && !record.Alias && !record.HasOptions() {
+			slog.DebugContext(r.Context(), "looking for record in db")
+			existing := URLData{}
+			err := backend_db.FindOne(r.Context(), url_data.DuplicateOf(record), &existing)
+			if err == nil {
+				slog.DebugContext(r.Context(), "record already exists", "code", existing.ShortCode)
+				setETag(w, existing)
+				sendJsonResponse(w, r, http.StatusOK, existing) //200
+				return
+			} else if err != nil && err != db_interface.ErrNoDocuments {
+				handleDBErrors(err)
+			}
 		}
+		protectRecord(&record)
 		// set missing properties
+		record.Host = hostOf(record.URL)
 		record.CreatedAt = time.Now()
 		record.UpdatedAt = record.CreatedAt
-		record.ShortCode = url_generator.GenerateShortURL(shortURLLen)
+		if !record.Alias {
+			record.ShortCode = generateShortCode(r, record.Domain)
+		}
+		record.Version = 1
+		release := reserveUsage(r, record, true)
 		// store new record in the db
-		log.Printf("[DEBUG] Inserting record into db...")
-		record.ID, err = backend_db.InsertOne(record)
+		slog.DebugContext(r.Context(), "inserting record into db", "code", record.ShortCode)
+		var err error
+		record.ID, err = backend_db.InsertOne(r.Context(), record)
+		if err != nil {
+			release()
+		}
 		handleDBErrors(err)
+		recordEvent(r.Context(), actorOf(r), record.ShortCode, audit.ActionCreate, nil, &record)
 		// return response
-		sendJsonResponse(w, http.StatusCreated, record) //201
+		setETag(w, record)
+		sendJsonResponse(w, r, http.StatusCreated, record) //201
 	default:
-		http.Error(w, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
 	}
 }
 
 // get statistics
-func retrieveRecord(short_url string, w http.ResponseWriter, include_ac bool) {
-	record := URLData{
-		ShortCode: short_url,
-	}
+func retrieveRecord(short_url string, w http.ResponseWriter, r *http.Request, include_ac bool) {
 	// retrieve short url from db
-	log.Printf("[DEBUG] Looking for record in db...")
-	err := backend_db.FindOne(record, &record)
+	slog.DebugContext(r.Context(), "looking for record in db", "code", short_url)
+	record := findRecord(r, apiDomainOf(r), short_url)
 	record.IncludeAccessCountInJSON(include_ac)
-	handleDBErrors(err)
-	// if not stats request, update count
-	if !include_ac {
-		new_rec := URLData{
-			AccessCount: record.AccessCount + 1,
+	requireSignature(r, record)
+	requireLinkPassword(r, record)
+	if record.PasswordHash != "" || record.SignedOnly {
+		w.Header().Set("Cache-Control", credentialsPolicy)
+	}
+	if include_ac {
+		// account for clicks not flushed yet
+		record.AccessCount += backend_clicks.Pending(record.Domain, short_url)
+		for variant, clicks := range backend_clicks.PendingVariants(record.Domain, short_url) {
+			if record.VariantClicks == nil {
+				record.VariantClicks = map[string]int{}
+			}
+			record.VariantClicks[variant] += clicks
 		}
-		handleDBErrors(backend_db.UpdateOne(record, &new_rec))
+	} else {
+		// if not stats request, count click
+		countClick(record.Domain, short_url, "")
+		// representation only changes along with the version
+		setETag(w, record)
+		setLastModified(w, record.UpdatedAt)
 	}
-	sendJsonResponse(w, http.StatusOK, record) // 200
+	sendJsonResponse(w, r, http.StatusOK, record) // 200
 }
 
-// get list
-func getList(w http.ResponseWriter) {
-	log.Printf("[DEBUG] Obtaining list of records...")
+// get list, optionally filtered by ?tag= and ?folder=
+func getList(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "obtaining list of records")
 	records := make([]URLData, listMaxLen)
-	handleDBErrors(backend_db.FindSome(len(records), &records))
-	sendJsonResponse(w, http.StatusOK, records)
+	handleDBErrors(backend_db.FindSome(r.Context(), listFilterOf(r), len(records), &records))
+	for i := range records {
+		records[i].Redact()
+	}
+	sendJsonResponse(w, r, http.StatusOK, records)
 }
 
 // obtain registered url
@@ -158,36 +362,68 @@ func handleGET(w http.ResponseWriter, r *http.Request) {
 	tokens := tokenizePath(r.URL.Path)
 	switch len(tokens) {
 	case 2:
-		if tokens[1] == "list" {
-			getList(w)
-		} else {
-			retrieveRecord(tokens[1], w, false)
+		switch tokens[1] {
+		case "list":
+			getList(w, r)
+		case "search":
+			searchRecords(w, r)
+		default:
+			retrieveRecord(tokens[1], w, r, false)
 		}
 	case 3:
-		if tokens[2] == "stats" {
-			retrieveRecord(tokens[1], w, true) // stats
-		} else {
-			http.Error(w, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		switch tokens[2] {
+		case "stats":
+			retrieveRecord(tokens[1], w, r, true) // stats
+		case "qr":
+			getQR(tokens[1], w, r)
+		case "history":
+			getHistory(tokens[1], w, r)
+		default:
+			httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
 		}
 	default:
-		http.Error(w, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
 	}
 }
 
-// update registered url
+// replace registered url
 func handlePUT(w http.ResponseWriter, r *http.Request) {
 	tokens := tokenizePath(r.URL.Path)
 	switch len(tokens) {
 	case 2:
-		replaceWhat := URLData{
-			ShortCode: tokens[1],
-		}
 		replaceWith := recordFromBody(r)
-		replaceWith.UpdatedAt = time.Now()
-		handleDBErrors(backend_db.UpdateOne(replaceWhat, &replaceWith))
-		sendJsonResponse(w, http.StatusOK, replaceWith) // 200
+		// keep previous version for the audit trail
+		old := findRecord(r, apiDomainOf(r), tokens[1])
+		checkIfMatch(r, old)
+		// password can't be read back, so protection stays unless a new password is set
+		replaceWith.PasswordHash = old.PasswordHash
+		protectRecord(&replaceWith)
+		prepareRecord(r, &replaceWith)
+		stored := storeRecord(r, old, &replaceWith)
+		recordEvent(r.Context(), actorOf(r), tokens[1], audit.ActionUpdate, &old, &stored)
+		setETag(w, stored)
+		stored.Redact()
+		sendJsonResponse(w, r, http.StatusOK, stored) // 200
 	default:
-		http.Error(w, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+	}
+}
+
+// partially update registered url (JSON merge patch)
+func handlePATCH(w http.ResponseWriter, r *http.Request) {
+	tokens := tokenizePath(r.URL.Path)
+	switch len(tokens) {
+	case 2:
+		old := findRecord(r, apiDomainOf(r), tokens[1])
+		checkIfMatch(r, old)
+		patched := patchRecord(r, old)
+		stored := storeRecord(r, old, &patched)
+		recordEvent(r.Context(), actorOf(r), tokens[1], audit.ActionUpdate, &old, &stored)
+		setETag(w, stored)
+		stored.Redact()
+		sendJsonResponse(w, r, http.StatusOK, stored) // 200
+	default:
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
 	}
 }
 
@@ -197,26 +433,46 @@ func handleDELETE(w http.ResponseWriter, r *http.Request) {
 	switch len(tokens) {
 	case 2:
 		short_url := tokens[1]
-		record := URLData{
-			ShortCode: short_url,
+		// soft delete, purged after retention period
+		old := findRecord(r, apiDomainOf(r), short_url)
+		checkIfMatch(r, old)
+		deletion := URLData{
+			Deleted:   true,
+			DeletedAt: time.Now(),
+			Version:   old.Version + 1,
+		}
+		filter := url_data.ByCode(old.Domain, short_url)
+		filter.Version = old.Version
+		err := backend_db.UpdateOne(r.Context(), filter, &deletion)
+		if err == db_interface.ErrNoDocuments {
+			panic(httpErr{
+				code:  http.StatusPreconditionFailed,
+				descr: "link was modified concurrently"})
 		}
-		handleDBErrors(backend_db.DeleteOne(record))
+		handleDBErrors(err)
+		releaseUsage(r.Context(), old)
+		recordEvent(r.Context(), actorOf(r), short_url, audit.ActionDelete, &old, nil)
 		w.WriteHeader(http.StatusNoContent) //204
 		fmt.Fprintf(w, "Deleted %s\n", short_url)
 	default:
-		http.Error(w, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
 	}
 }
 
 // recover function
-func recover_hdl(w http.ResponseWriter) {
-	if r := recover(); r != nil {
-		log.Printf("[ERROR] %v", r)
-		switch err := r.(type) {
+func recover_hdl(w http.ResponseWriter, r *http.Request) {
+	if rec := recover(); rec != nil {
+		switch err := rec.(type) {
 		case httpErr:
-			http.Error(w, err.descr, err.code)
+			level := slog.LevelWarn
+			if err.code >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			slog.Log(r.Context(), level, "request failed", "status", err.code, "error", err.descr)
+			sendError(w, r, errorResponse{Error: err.descr, Quota: err.quota}, err.code)
 		default:
-			http.Error(w, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError) //500
+			slog.ErrorContext(r.Context(), "request panicked", "error", err)
+			httpError(w, r, fmt.Sprintf("Internal error: %v", err), http.StatusInternalServerError) //500
 		}
 	}
 }
@@ -224,7 +480,9 @@ func recover_hdl(w http.ResponseWriter) {
 // handle http requests
 func shorten(w http.ResponseWriter, r *http.Request) {
 	// handle panic
-	defer recover_hdl(w)
+	defer recover_hdl(w, r)
+	setCachePolicy(w, r)
+	r = authenticate(r)
 
 	switch r.Method {
 	case "POST":
@@ -233,6 +491,8 @@ func shorten(w http.ResponseWriter, r *http.Request) {
 		handleGET(w, r)
 	case "PUT":
 		handlePUT(w, r)
+	case "PATCH":
+		handlePATCH(w, r)
 	case "DELETE":
 		handleDELETE(w, r)
 	default:
@@ -240,37 +500,85 @@ func shorten(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// liveness probe
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readiness probe
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if shutting_down.Load() {
+		httpError(w, r, "shutting down", http.StatusServiceUnavailable) //503
+		return
+	}
+	if backend_pinger != nil {
+		if err := backend_pinger.Ping(r.Context()); err != nil {
+			slog.ErrorContext(r.Context(), "DB ping failed", "error", err)
+			httpError(w, r, fmt.Sprintf("DB unreachable: %v", err), http.StatusServiceUnavailable) //503
+			return
+		}
+	}
+	fmt.Fprintln(w, "ready")
+}
+
 // start server
 func Start(port int, collection DB) {
 	if collection == nil {
-		log.Fatalf("[ERROR] db collection is nil")
+		slog.Error("db collection is nil")
+		os.Exit(1)
 	}
 	backend_db = collection
+	shutting_down.Store(false)
+	backend_clicks = clicks.NewAggregator(collection, click_flush_interval, click_flush_threshold)
+	backend_clicks.Start()
+	startPurger()
 	mux := http.NewServeMux()
 	// Register handler functions with the ServeMux
 	mux.HandleFunc("/shorten", shorten)
 	mux.HandleFunc("/shorten/", shorten)
-	// Render front html page
-	fs := http.FileServer(http.Dir("./frontend"))
-	mux.Handle("/", fs)
+	mux.HandleFunc("/campaigns", campaigns)
+	mux.HandleFunc("/campaigns/", campaigns)
+	mux.HandleFunc("/workspaces", workspaces)
+	mux.HandleFunc("/workspaces/", workspaces)
+	mux.HandleFunc("/workspace", workspaces)
+	mux.HandleFunc("/workspace/", workspaces)
+	mux.HandleFunc("/me/usage", me)
+	mux.HandleFunc("/auth/", auth)
+	// Probes
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	// Expose prometheus metrics
+	mux.Handle("/metrics", metrics.Handler())
+	// Render front html page, redirect short codes
+	fs := http.FileServer(http.Dir(frontendDir))
+	mux.Handle("/", root(fs))
 
 	backend_server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Handler: tracing.Middleware(routeOf, logging.Middleware(metrics.Middleware(routeOf, mux))),
 	}
 
-	if err := backend_server.ListenAndServe(); err != nil {
-		log.Printf("[ERROR] %v", err)
+	if err := backend_server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("server stopped", "error", err)
 	}
 }
 
 // shutdown server
 func ShutDown() {
-	log.Println("[DEBUG] Shutting down gracefully")
+	slog.Info("shutting down gracefully")
+	// fail readiness first so load balancers stop sending traffic
+	shutting_down.Store(true)
+	if shutdown_delay > 0 {
+		slog.Info("draining", "delay", shutdown_delay)
+		time.Sleep(shutdown_delay)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := backend_server.Shutdown(ctx); err != nil {
-		log.Printf("[ERROR] %v", err)
+		slog.Error("shutdown failed", "error", err)
 	}
-	log.Println("[DEBUG] Server shut down")
+	// persist clicks counted so far
+	backend_clicks.Stop(ctx)
+	stopPurger()
+	slog.Info("server shut down")
 }
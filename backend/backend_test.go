@@ -1,21 +1,37 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
+	"url-shortener/audit"
+	"url-shortener/clicks"
+	"url-shortener/geoip"
+	"url-shortener/logging"
+	"url-shortener/url_data"
+	"url-shortener/url_signer"
 )
 
 var mock_db = dbCollectionMock{}
 
 // helpers
 
-func testHTTP(method, url, body string) *httptest.ResponseRecorder {
+func setupMocks() {
 	backend_db = &mock_db
+	if backend_clicks == nil {
+		backend_clicks = clicks.NewAggregator(&mock_db, time.Hour, 0)
+	}
+}
+
+func testHTTP(method, url, body string) *httptest.ResponseRecorder {
+	setupMocks()
 
 	w := httptest.NewRecorder()
 	// mock request
@@ -35,6 +51,9 @@ func testResult(w *httptest.ResponseRecorder, ref URLData) (*URLData, error) {
 	if err := json.Unmarshal(body, &url_data); err != nil {
 		return nil, fmt.Errorf("json error %v", err)
 	}
+	// computed, see TestDomains and TestPublicURL
+	url_data.ShortURL = ""
+	url_data.Links = nil
 	if url_data.String() != ref.String() {
 		return nil, fmt.Errorf("invalid response: %v", url_data)
 	}
@@ -98,6 +117,26 @@ func TestPOSTInsertion(t *testing.T) {
 	}
 }
 
+func TestPOSTNotSharedWithOptions(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "http://someurl", ShortCode: "abc123", Rules: []url_data.Rule{{Platforms: []string{"ios"}, URL: "http://someurl/ios"}}},
+		URLData{ID: "2", URL: "http://someurl", ShortCode: "abc124", SignedOnly: true},
+	)
+	defer func() { mock_db.data = mock_db.data[:0] }()
+	// plain links don't reuse links with options
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl"}`); w.Code != http.StatusCreated || len(mock_db.data) != 3 {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	// nor are links with options shared
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl", "signedOnly": true}`); w.Code != http.StatusCreated || len(mock_db.data) != 4 {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl"}`); w.Code != http.StatusOK || len(mock_db.data) != 4 {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+}
+
 // GET
 func TestGETInvalidURL(t *testing.T) {
 	if w := testHTTP("GET", "/shorten/", ""); w.Code != http.StatusNotFound {
@@ -130,6 +169,10 @@ func TestGETRetrieve(t *testing.T) {
 	if err != nil {
 		t.Errorf("%v", err)
 	}
+	if mock_db.data[0].AccessCount != 3 {
+		t.Error("shouldn't write access counter synchronously")
+	}
+	backend_clicks.Flush(context.Background())
 	if mock_db.data[0].AccessCount != 4 {
 		t.Error("should increment access counter")
 	}
@@ -161,6 +204,115 @@ func TestGETStats(t *testing.T) {
 	}
 }
 
+func TestGETStatsPendingClicks(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	// add record to db
+	mock_db.data = append(mock_db.data, URLData{
+		ID:          "1",
+		URL:         "http://someurl.com",
+		ShortCode:   "abc123",
+		AccessCount: 3,
+	})
+	testHTTP("GET", "/shorten/abc123", "")
+	testHTTP("GET", "/shorten/abc123", "")
+
+	w := testHTTP("GET", "/shorten/abc123/stats", "")
+	url_data := URLData{}
+	if err := json.Unmarshal(w.Body.Bytes(), &url_data); err != nil {
+		t.Errorf("json error %v", err)
+	}
+	if url_data.AccessCount != 5 {
+		t.Errorf("stats should include pending clicks, got %d", url_data.AccessCount)
+	}
+	backend_clicks.Flush(context.Background())
+	if mock_db.data[0].AccessCount != 5 || backend_clicks.Backlog() != 0 {
+		t.Errorf("clicks weren't flushed")
+	}
+}
+
+func TestGETConditional(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	updated := time.Date(2024, 11, 29, 10, 23, 46, 0, time.UTC)
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com",
+		ShortCode: "abc123",
+		UpdatedAt: updated,
+		Version:   2,
+	})
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		setupMocks()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		shorten(w, req)
+		return w
+	}
+
+	w := get("/shorten/abc123", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag != `"2"` {
+		t.Errorf("invalid response %v, etag %s", w.Code, etag)
+	}
+	if lm := w.Header().Get("Last-Modified"); lm != updated.Format(http.TimeFormat) {
+		t.Errorf("invalid Last-Modified %s", lm)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != cachePolicies["/shorten/{code}"] {
+		t.Errorf("invalid Cache-Control %s", cc)
+	}
+
+	// revalidation
+	if w := get("/shorten/abc123", map[string]string{"If-None-Match": `"1", ` + etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := get("/shorten/abc123", map[string]string{"If-None-Match": "W/" + etag}); w.Code != http.StatusNotModified {
+		t.Errorf("weak comparison should match, got %v", w.Code)
+	}
+	if w := get("/shorten/abc123", map[string]string{"If-Modified-Since": updated.Format(http.TimeFormat)}); w.Code != http.StatusNotModified {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := get("/shorten/abc123", map[string]string{"If-Modified-Since": updated.Add(-time.Second).Format(http.TimeFormat)}); w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// If-None-Match takes precedence
+	if w := get("/shorten/abc123", map[string]string{"If-None-Match": `"1"`, "If-Modified-Since": updated.Format(http.TimeFormat)}); w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// stats change with every click
+	w = get("/shorten/abc123/stats", nil)
+	stats_etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || stats_etag == "" || w.Header().Get("Last-Modified") != "" {
+		t.Errorf("invalid stats caching headers %v", w.Header())
+	}
+	if w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("invalid Cache-Control %s", w.Header().Get("Cache-Control"))
+	}
+	if w := get("/shorten/abc123/stats", map[string]string{"If-None-Match": stats_etag}); w.Code != http.StatusNotModified {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	get("/shorten/abc123", nil)
+	if w := get("/shorten/abc123/stats", map[string]string{"If-None-Match": stats_etag}); w.Code != http.StatusOK {
+		t.Errorf("stats should have changed, got %v", w.Code)
+	}
+
+	// credentials required
+	mock_db.data[0].PasswordHash = hashPassword("secret")
+	w = get("/shorten/abc123", map[string]string{linkPasswordHeader: "secret"})
+	if cc := w.Header().Get("Cache-Control"); w.Code != http.StatusOK || cc != credentialsPolicy {
+		t.Errorf("protected link shouldn't be cached publicly: %v %s", w.Code, cc)
+	}
+	// errors and changes aren't cached
+	if w := get("/shorten/qwe345", nil); w.Code != http.StatusNotFound || w.Header().Get("Cache-Control") != noStore {
+		t.Errorf("errors shouldn't be cached: %v", w.Header())
+	}
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someotherurl"}`); w.Header().Get("Cache-Control") != noStore {
+		t.Errorf("changes shouldn't be cached: %v", w.Header())
+	}
+}
+
 func TestGETList(t *testing.T) {
 	mock_db.data = mock_db.data[:0] //clear data
 	mock_db.data = append(mock_db.data, URLData{
@@ -192,6 +344,11 @@ func TestGETList(t *testing.T) {
 	if len(result) != 2 {
 		t.Error("invalid len returned")
 	}
+	for i := range result {
+		// computed, see TestDomains and TestPublicURL
+		result[i].ShortURL = ""
+		result[i].Links = nil
+	}
 	res_str := fmt.Sprintf("%s", result)
 	ref_str := fmt.Sprintf("%s", mock_db.data)
 	if res_str != ref_str {
@@ -199,6 +356,719 @@ func TestGETList(t *testing.T) {
 	}
 }
 
+func TestGETListFiltered(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	testHTTP("POST", "/shorten", `{"url": "http://someurl.com", "tags": [" spring ", "email", "spring", ""], "folder": "/marketing/2024/"}`)
+	testHTTP("POST", "/shorten", `{"url": "http://someotherurl.com", "tags": ["spring"], "folder": "sales"}`)
+	testHTTP("POST", "/shorten", `{"url": "http://yetanotherurl.com", "description": "no labels"}`)
+	if len(mock_db.data) != 3 {
+		t.Fatalf("records weren't inserted")
+	}
+	if tags := mock_db.data[0].Tags; len(tags) != 2 || tags[0] != "spring" || tags[1] != "email" {
+		t.Errorf("tags weren't normalized: %q", tags)
+	}
+	if mock_db.data[0].Folder != "marketing/2024" {
+		t.Errorf("folder wasn't normalized: %q", mock_db.data[0].Folder)
+	}
+
+	list := func(query string) []URLData {
+		w := testHTTP("GET", "/shorten/list"+query, "")
+		var result []URLData
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Errorf("json error %v", err)
+		}
+		return result
+	}
+	if result := list("?tag=spring"); len(result) != 2 {
+		t.Errorf("invalid len returned %d", len(result))
+	}
+	if result := list("?tag=spring&folder=sales"); len(result) != 1 || result[0].URL != "http://someotherurl.com" {
+		t.Errorf("invalid result %v", result)
+	}
+	if result := list("?folder=marketing/2024"); len(result) != 1 || result[0].Folder != "marketing/2024" {
+		t.Errorf("invalid result %v", result)
+	}
+	if result := list("?tag=none"); len(result) != 0 {
+		t.Errorf("invalid len returned %d", len(result))
+	}
+
+	// limits
+	tags := strings.Split(strings.Repeat("x,", maxTags)+"y", ",")
+	body, _ := json.Marshal(map[string]any{"url": "http://fourthurl.com", "tags": tags})
+	if w := testHTTP("POST", "/shorten", string(body)); w.Code != http.StatusCreated {
+		t.Errorf("duplicate tags shouldn't count, got %v", w.Code)
+	}
+	for i := range tags {
+		tags[i] = fmt.Sprintf("tag%d", i)
+	}
+	body, _ = json.Marshal(map[string]any{"url": "http://fifthurl.com", "tags": tags})
+	if w := testHTTP("POST", "/shorten", string(body)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestGETSearch(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	testHTTP("POST", "/shorten", `{"url": "http://shop.example.com/spring"}`)
+	testHTTP("POST", "/shorten", `{"url": "http://someurl.com", "title": "Spring sale"}`)
+	testHTTP("POST", "/shorten", `{"url": "http://someotherurl.com", "tags": ["newsletter"]}`)
+	testHTTP("POST", "/shorten", `{"url": "http://deletedurl.com/spring"}`)
+	testHTTP("DELETE", "/shorten/"+mock_db.data[3].ShortCode, "")
+
+	search := func(query string) []URLData {
+		w := testHTTP("GET", "/shorten/search?q="+url.QueryEscape(query), "")
+		if w.Code != http.StatusOK {
+			t.Errorf("invalid response code %v", w.Code)
+		}
+		var result []URLData
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Errorf("json error %v", err)
+		}
+		return result
+	}
+	// title ranks higher than url, deleted links aren't found
+	result := search("spring")
+	if len(result) != 2 || result[0].Title != "Spring sale" || result[1].URL != "http://shop.example.com/spring" {
+		t.Errorf("invalid result %v", result)
+	}
+	// any term matches, like with a text index
+	if result := search("example.com"); len(result) != 3 || result[0].URL != "http://shop.example.com/spring" {
+		t.Errorf("host wasn't matched: %v", result)
+	}
+	if result := search("Newsletter"); len(result) != 1 || result[0].URL != "http://someotherurl.com" {
+		t.Errorf("tag wasn't matched: %v", result)
+	}
+	if result := search("winter"); len(result) != 0 {
+		t.Errorf("invalid result %v", result)
+	}
+	if w := testHTTP("GET", "/shorten/search?q=", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestGETQR(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com",
+		ShortCode: "abc123",
+	})
+
+	w := testHTTP("GET", "/shorten/abc123/qr", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("invalid content type %s", ct)
+	}
+	if !strings.HasPrefix(w.Body.String(), "\x89PNG") {
+		t.Error("response isn't a png")
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Cache-Control") == "" {
+		t.Error("missing caching headers")
+	}
+
+	w = testHTTP("GET", "/shorten/abc123/qr?format=svg&size=128&ecc=h", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("invalid response %v %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Body.String(), "<svg") {
+		t.Error("response isn't an svg")
+	}
+
+	// conditional request
+	req := httptest.NewRequest("GET", "/shorten/abc123/qr", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	shorten(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// invalid parameters are rejected before revalidation
+	req = httptest.NewRequest("GET", "/shorten/abc123/qr?size=10", nil)
+	req.Header.Set("If-None-Match", "*")
+	w = httptest.NewRecorder()
+	shorten(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	for _, query := range []string{"format=gif", "size=abc", "size=10", "ecc=X"} {
+		if w := testHTTP("GET", "/shorten/abc123/qr?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid response code %v for %s", w.Code, query)
+		}
+	}
+	if w := testHTTP("GET", "/shorten/qwe345/qr", ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+// redirect
+func TestRedirect(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com",
+		ShortCode: "abc123",
+	})
+	handler := root(http.NotFoundHandler())
+	setupMocks()
+	pending := backend_clicks.Pending("", "abc123")
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/abc123", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "http://someurl.com" {
+		t.Errorf("invalid location %s", loc)
+	}
+	if backend_clicks.Pending("", "abc123") != pending+1 {
+		t.Error("click wasn't counted")
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/qwe345", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestRedirectPassthrough(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "https://docs.example.com/?lang=en", ShortCode: "docs", PassPath: true, PassQuery: true},
+		URLData{ID: "2", URL: "http://someurl.com/?a=1&b=2", ShortCode: "abc123", PassQuery: true, QueryConflict: "incoming"},
+		URLData{ID: "3", URL: "http://someurl.com/?a=1", ShortCode: "qwe345", PassQuery: true, QueryConflict: "append"},
+		URLData{ID: "4", URL: "http://someurl.com/", ShortCode: "zxc678"},
+	)
+	setupMocks()
+	handler := root(http.NotFoundHandler())
+	resolve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	locations := map[string]string{
+		"/docs":                           "https://docs.example.com/?lang=en",
+		"/docs/api/v2":                    "https://docs.example.com/api/v2?lang=en",
+		"/docs/api/a%2Fb?q=1":             "https://docs.example.com/api/a%2Fb?lang=en&q=1",
+		"/docs/api?lang=de&continue=1":    "https://docs.example.com/api?lang=en",
+		"/abc123?b=3&c=4":                 "http://someurl.com/?a=1&b=3&c=4",
+		"/qwe345?a=2&preview=0&continue=": "http://someurl.com/?a=1&a=2",
+		"/zxc678?a=1":                     "http://someurl.com/",
+	}
+	for path, ref := range locations {
+		w := resolve(path)
+		if w.Code != http.StatusFound {
+			t.Errorf("invalid response code %v for %s", w.Code, path)
+		}
+		if loc := w.Header().Get("Location"); loc != ref {
+			t.Errorf("invalid location %s for %s", loc, path)
+		}
+	}
+	// path isn't passed through, nor dot segments leaving the destination path
+	for _, path := range []string{"/zxc678/more", "/docs/../../etc", "/docs/api/%2e%2e/%2E%2E/etc", "/docs/./api"} {
+		if w := resolve(path); w.Code != http.StatusNotFound {
+			t.Errorf("invalid response code %v for %s", w.Code, path)
+		}
+	}
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl.com", "passQuery": true, "queryConflict": "merge"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	backend_clicks.Flush(context.Background())
+}
+
+func TestRedirectRules(t *testing.T) {
+	countries, err := geoip.Load(strings.NewReader("203.0.113.0/24,AT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGeoIP(countries)
+	defer SetGeoIP(nil)
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{ID: "1", URL: "http://someurl.com/", ShortCode: "abc123", Rules: []url_data.Rule{
+		{Platforms: []string{"ios"}, URL: "https://apps.apple.com/app/id1"},
+		{Platforms: []string{"android"}, URL: "https://play.google.com/store/apps/details?id=app"},
+		{Countries: []string{"AT"}, URL: "http://someurl.com/at"},
+		{Languages: []string{"de"}, Until: &past, URL: "http://someurl.com/expired"},
+		{Languages: []string{"de"}, From: &past, Until: &future, URL: "http://someurl.com/de"},
+	}})
+	setupMocks()
+	handler := root(http.NotFoundHandler())
+	resolve := func(user_agent, accept_language, remote_addr string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/abc123", nil)
+		r.Header.Set("User-Agent", user_agent)
+		r.Header.Set("Accept-Language", accept_language)
+		r.RemoteAddr = remote_addr
+		handler(w, r)
+		if w.Code != http.StatusFound {
+			t.Errorf("invalid response code %v", w.Code)
+		}
+		if !strings.Contains(w.Header().Get("Vary"), "User-Agent") {
+			t.Error("missing Vary header")
+		}
+		return w.Header().Get("Location")
+	}
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"
+	android := "Mozilla/5.0 (Linux; Android 14; Pixel 8)"
+	desktop := "Mozilla/5.0 (X11; Linux x86_64)"
+	cases := []struct{ user_agent, accept_language, remote_addr, location string }{
+		{iphone, "de-AT", "203.0.113.7:1234", "https://apps.apple.com/app/id1"}, // first match wins
+		{android, "", "192.0.2.1:1234", "https://play.google.com/store/apps/details?id=app"},
+		{desktop, "de-AT", "203.0.113.7:1234", "http://someurl.com/at"},
+		{desktop, "en;q=0.9, de-AT;q=0.5", "192.0.2.1:1234", "http://someurl.com/de"},
+		{desktop, "en, de;q=0", "192.0.2.1:1234", "http://someurl.com/"}, // fallback
+		{desktop, "", "192.0.2.1:1234", "http://someurl.com/"},
+	}
+	for _, c := range cases {
+		if loc := resolve(c.user_agent, c.accept_language, c.remote_addr); loc != c.location {
+			t.Errorf("invalid location %s for %+v", loc, c)
+		}
+	}
+	backend_clicks.Flush(context.Background())
+
+	// validation
+	invalid := []string{
+		`{"url": "http://someurl.com", "rules": [{"platforms": ["ios"]}]}`,
+		`{"url": "http://someurl.com", "rules": [{"platforms": ["windows"], "url": "http://someurl.com/w"}]}`,
+		`{"url": "http://someurl.com", "rules": [{"countries": ["AUT"], "url": "http://someurl.com/at"}]}`,
+		`{"url": "http://someurl.com", "rules": [{"from": "2025-02-01T00:00:00Z", "until": "2025-01-01T00:00:00Z", "url": "http://someurl.com/x"}]}`,
+	}
+	for _, body := range invalid {
+		if w := testHTTP("POST", "/shorten", body); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid response code %v for %s", w.Code, body)
+		}
+	}
+	w := testHTTP("POST", "/shorten", `{"url": "http://someurl.com/rules", "rules": [{"platforms": [" iOS "], "countries": ["at"], "url": "https://apps.apple.com/app/id1"}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invalid response code %v", w.Code)
+	}
+	created := URLData{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if len(created.Rules) != 1 || created.Rules[0].Platforms[0] != "ios" || created.Rules[0].Countries[0] != "AT" {
+		t.Errorf("rules not normalized: %v", created.Rules)
+	}
+}
+
+func TestRedirectVariants(t *testing.T) {
+	variants := []url_data.Variant{{Name: "a", Weight: 3}, {Name: "b", Weight: 1}}
+	for n, ref := range []string{"a", "a", "a", "b"} {
+		if variant := variantAt(variants, n); variant.Name != ref {
+			t.Errorf("invalid variant %s at %d", variant.Name, n)
+		}
+	}
+
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "http://someurl.com/", ShortCode: "abc123", Variants: []url_data.Variant{
+			{Name: "a", URL: "http://someurl.com/a", Weight: 1},
+			{Name: "b", URL: "http://someurl.com/b", Weight: 1},
+		}},
+		URLData{ID: "2", URL: "http://someurl.com/", ShortCode: "qwe345", StickyVariants: true, Variants: []url_data.Variant{
+			{Name: "a", URL: "http://someurl.com/a", Weight: 1},
+			{Name: "b", URL: "http://someurl.com/b", Weight: 1},
+		}},
+	)
+	setupMocks()
+	backend_clicks.Flush(context.Background())
+	handler := root(http.NotFoundHandler())
+	resolve := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		handler(w, r)
+		if w.Code != http.StatusFound {
+			t.Errorf("invalid response code %v", w.Code)
+		}
+		return w
+	}
+	// random split, 2^-99 chance to miss a variant
+	locations := map[string]int{}
+	for range 100 {
+		w := resolve("/abc123")
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("non-sticky variant shouldn't set cookies")
+		}
+		locations[w.Header().Get("Location")]++
+	}
+	if len(locations) != 2 || locations["http://someurl.com/a"]+locations["http://someurl.com/b"] != 100 {
+		t.Errorf("invalid split %v", locations)
+	}
+	// sticky variant is remembered
+	w := resolve("/qwe345")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "v_qwe345" || cookies[0].Path != "/qwe345" {
+		t.Fatalf("invalid cookies %v", cookies)
+	}
+	location := w.Header().Get("Location")
+	for range 10 {
+		if w := resolve("/qwe345", cookies[0]); w.Header().Get("Location") != location || len(w.Result().Cookies()) != 0 {
+			t.Errorf("sticky variant changed to %s", w.Header().Get("Location"))
+		}
+	}
+	// unknown variant is replaced
+	if w := resolve("/qwe345", &http.Cookie{Name: "v_qwe345", Value: "x"}); len(w.Result().Cookies()) != 1 {
+		t.Error("unknown variant should be reassigned")
+	}
+
+	// stats include per-variant clicks, flushed or not
+	stats := func() URLData {
+		w := testHTTP("GET", "/shorten/abc123/stats", "")
+		result := struct {
+			AccessCount   int            `json:"accessCount"`
+			VariantClicks map[string]int `json:"variantClicks"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return URLData{AccessCount: result.AccessCount, VariantClicks: result.VariantClicks}
+	}
+	for _, flush := range []bool{false, true} {
+		if flush {
+			backend_clicks.Flush(context.Background())
+		}
+		record := stats()
+		if record.AccessCount != 100 || record.VariantClicks["a"] != locations["http://someurl.com/a"] ||
+			record.VariantClicks["b"] != locations["http://someurl.com/b"] {
+			t.Errorf("invalid stats %d %v", record.AccessCount, record.VariantClicks)
+		}
+	}
+	// metadata doesn't include clicks
+	if w := testHTTP("GET", "/shorten/abc123", ""); strings.Contains(w.Body.String(), "variantClicks") {
+		t.Errorf("invalid response %s", w.Body.String())
+	}
+
+	// validation
+	invalid := []string{
+		`{"url": "http://someurl.com", "variants": [{"url": "/relative"}]}`,
+		`{"url": "http://someurl.com", "variants": [{"name": "a.b", "url": "http://someurl.com/a"}]}`,
+		`{"url": "http://someurl.com", "variants": [{"name": "a", "url": "http://someurl.com/a"}, {"name": "a", "url": "http://someurl.com/b"}]}`,
+		`{"url": "http://someurl.com", "variants": [{"url": "http://someurl.com/a", "weight": -1}]}`,
+	}
+	for _, body := range invalid {
+		if w := testHTTP("POST", "/shorten", body); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid response code %v for %s", w.Code, body)
+		}
+	}
+	w = testHTTP("POST", "/shorten", `{"url": "http://someurl.com/ab", "variants": [{"url": "http://someurl.com/a"}, {"url": "http://someurl.com/b", "weight": 2}]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invalid response code %v", w.Code)
+	}
+	created := URLData{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if len(created.Variants) != 2 || created.Variants[0].Name != "a" || created.Variants[0].Weight != 1 || created.Variants[1].Name != "b" {
+		t.Errorf("variants not completed: %v", created.Variants)
+	}
+}
+
+func TestRedirectPreview(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com/page",
+		ShortCode: "abc123",
+		Title:     "Some <page>",
+	})
+	setupMocks()
+	handler := root(http.NotFoundHandler())
+	pending := backend_clicks.Pending("", "abc123")
+
+	for _, path := range []string{"/abc123+", "/abc123?preview=1"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("invalid response code %v", w.Code)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "http://someurl.com/page") || !strings.Contains(body, "Some &lt;page&gt;") {
+			t.Errorf("invalid preview page %s", body)
+		}
+		if !strings.Contains(body, "/abc123?continue=1") {
+			t.Error("preview page should link to the redirect")
+		}
+	}
+	if backend_clicks.Pending("", "abc123") != pending {
+		t.Error("preview shouldn't count clicks")
+	}
+}
+
+func TestRedirectInterstitial(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:           "1",
+		URL:          "http://someurl.com",
+		ShortCode:    "abc123",
+		Interstitial: true,
+	})
+	setupMocks()
+	handler := root(http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/abc123", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Warning") {
+		t.Errorf("should show warning page, got %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/abc123?continue=1", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+// password protection
+func TestPasswordProtected(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	password_lockout.entries = make(map[string]*lockoutEntry)
+
+	w := testHTTP("POST", "/shorten", `{"url": "http://someurl", "password": "s3cret"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invalid response code %v", w.Code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "s3cret") || strings.Contains(body, mock_db.data[0].PasswordHash) {
+		t.Errorf("password leaked: %s", body)
+	}
+	if !strings.Contains(body, `"protected":true`) {
+		t.Errorf("should be marked protected: %s", body)
+	}
+	code := mock_db.data[0].ShortCode
+
+	lookup := func(password string) int {
+		setupMocks()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/shorten/"+code, nil)
+		if password != "" {
+			req.Header.Set(linkPasswordHeader, password)
+		}
+		shorten(w, req)
+		return w.Code
+	}
+	if c := lookup(""); c != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", c)
+	}
+	if c := lookup("s3cret"); c != http.StatusOK {
+		t.Errorf("invalid response code %v", c)
+	}
+	// lockout
+	for i := 0; i < maxPasswordFailures; i++ {
+		if c := lookup("wrong"); c != http.StatusUnauthorized {
+			t.Errorf("invalid response code %v", c)
+		}
+	}
+	if c := lookup("s3cret"); c != http.StatusTooManyRequests {
+		t.Errorf("should be locked out, got %v", c)
+	}
+	// responses which don't check the password hide the destination
+	events := &eventCollectionMock{}
+	SetAuditCollection(events)
+	defer SetAuditCollection(nil)
+	if w := testHTTP("PUT", "/shorten/"+code, `{"url": "http://someurl", "title": "secret place"}`); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "http://someurl") {
+		t.Errorf("url leaked: %v %s", w.Code, w.Body.String())
+	}
+	if w := testHTTP("GET", "/shorten/list", ""); strings.Contains(w.Body.String(), "http://someurl") || !strings.Contains(w.Body.String(), "secret place") {
+		t.Errorf("url leaked: %s", w.Body.String())
+	}
+	if w := testHTTP("GET", "/shorten/"+code+"/history", ""); strings.Contains(w.Body.String(), "http://someurl") || !strings.Contains(w.Body.String(), `"protected":true`) {
+		t.Errorf("url leaked: %s", w.Body.String())
+	}
+	if len(events.events) != 1 || events.events[0].Old.PasswordHash != "" || events.events[0].New.PasswordHash != "" {
+		t.Errorf("password hash stored in audit trail %+v", events.events)
+	}
+	// same url without password is a separate link
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl"}`); w.Code != http.StatusCreated {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestLockoutPrune(t *testing.T) {
+	l := &lockout{entries: make(map[string]*lockoutEntry), max: 3, period: 10 * time.Millisecond}
+	l.fail("a") // single failure
+	l.fail("b") // locked out
+	l.fail("b")
+	l.fail("b")
+	if len(l.entries) != 2 || l.entries["b"].until.IsZero() {
+		t.Errorf("invalid entries %v", l.entries)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// expired entries are dropped, whether they were locked out or not
+	l.fail("c")
+	if len(l.entries) != 1 || l.entries["c"] == nil {
+		t.Errorf("expired entries weren't pruned: %v", l.entries)
+	}
+}
+
+func TestPasswordForm(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	password_lockout.entries = make(map[string]*lockoutEntry)
+	record := URLData{URL: "http://someurl.com", ShortCode: "abc123", Password: "s3cret"}
+	protectRecord(&record)
+	mock_db.data = append(mock_db.data, record)
+	setupMocks()
+	handler := root(http.NotFoundHandler())
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/abc123", nil))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "<form") {
+		t.Errorf("should show password form, got %v", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "someurl") {
+		t.Error("destination leaked")
+	}
+
+	post := func(password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/abc123", strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler(w, req)
+		return w
+	}
+	if w := post("wrong"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "wrong password") {
+		t.Errorf("should reject wrong password, got %v", w.Code)
+	}
+	w = post("s3cret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "http://someurl.com" {
+		t.Errorf("invalid response %v %s", w.Code, w.Header().Get("Location"))
+	}
+	// preview asks for the password again to continue
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/abc123+", nil)
+	req.Header.Set(linkPasswordHeader, "s3cret")
+	handler(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<form method="POST" action="/abc123?continue=1">`) {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+}
+
+// signed links
+func TestSignedLinks(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:         "1",
+		URL:        "http://someurl.com",
+		ShortCode:  "abc123",
+		SignedOnly: true,
+	})
+	SetSigner(nil)
+	if w := testHTTP("POST", "/shorten/abc123/sign", ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	signer, err := url_signer.Parse("k1:0123456789abcdef0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSigner(signer)
+	defer SetSigner(nil)
+
+	w := testHTTP("POST", "/shorten/abc123/sign", `{"expiresIn": "1h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invalid response code %v", w.Code)
+	}
+	link := signedLink{}
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+		t.Fatalf("json error %v", err)
+	}
+	u, err := url.Parse(link.URL)
+	if err != nil || u.Path != "/abc123" || u.Query().Get("sig") == "" {
+		t.Fatalf("invalid signed url %s", link.URL)
+	}
+
+	handler := root(http.NotFoundHandler())
+	resolve := func(path string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if c := resolve(u.RequestURI()); c != http.StatusFound {
+		t.Errorf("signed link should resolve, got %v", c)
+	}
+	if c := resolve("/abc123"); c != http.StatusForbidden {
+		t.Errorf("unsigned link shouldn't resolve, got %v", c)
+	}
+	if c := resolve(strings.Replace(u.RequestURI(), "exp=", "exp=1", 1)); c != http.StatusForbidden {
+		t.Errorf("tampered link shouldn't resolve, got %v", c)
+	}
+	if w := testHTTP("GET", "/shorten/abc123", ""); w.Code != http.StatusForbidden {
+		t.Errorf("lookup shouldn't reveal signed-only link, got %v", w.Code)
+	}
+	if w := testHTTP("GET", "/shorten/list", ""); strings.Contains(w.Body.String(), "http://someurl.com") {
+		t.Errorf("list shouldn't reveal signed-only link: %s", w.Body.String())
+	}
+	if w := testHTTP("PUT", "/shorten/abc123", `{"url": "http://someurl.com", "signedOnly": true}`); strings.Contains(w.Body.String(), "http://someurl.com") {
+		t.Errorf("update shouldn't reveal signed-only link: %s", w.Body.String())
+	}
+	// expired
+	past := time.Now().Add(-time.Minute)
+	expired := fmt.Sprintf("/abc123?exp=%d&sig=%s", past.Unix(), url.QueryEscape(signer.Sign("abc123", past)))
+	if c := resolve(expired); c != http.StatusGone {
+		t.Errorf("expired link shouldn't resolve, got %v", c)
+	}
+	for _, body := range []string{`{"expiresIn": "-1h"}`, `{"expiresIn": "abc"}`, `{"expiresAt": "2000-01-01T00:00:00Z"}`} {
+		if w := testHTTP("POST", "/shorten/abc123/sign", body); w.Code != http.StatusBadRequest {
+			t.Errorf("invalid response code %v for %s", w.Code, body)
+		}
+	}
+}
+
+// audit
+func TestHistory(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	SetAuditCollection(nil)
+	if w := testHTTP("GET", "/shorten/abc123/history", ""); w.Code != http.StatusNotImplemented {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	events := &eventCollectionMock{}
+	SetAuditCollection(events)
+	defer SetAuditCollection(nil)
+
+	w := testHTTP("POST", "/shorten", `{"url": "http://someurl"}`)
+	code := mock_db.data[0].ShortCode
+	testHTTP("PUT", "/shorten/"+code, `{"url": "http://someotherurl"}`)
+	testHTTP("DELETE", "/shorten/"+code, "")
+
+	// other domains and old events beyond the limit are left out
+	events.events = append(events.events, audit.Event{ShortCode: code, Domain: "acme.link", Action: "create", At: time.Now()})
+	for i := 0; i < historyMaxLen; i++ {
+		events.events = append(events.events, audit.Event{ShortCode: code, Action: "update", At: time.Now().Add(-time.Hour)})
+	}
+
+	w = testHTTP("GET", "/shorten/"+code+"/history", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("invalid response code %v", w.Code)
+	}
+	var history []struct {
+		Action string         `json:"action"`
+		Actor  string         `json:"actor"`
+		Old    map[string]any `json:"old"`
+		New    map[string]any `json:"new"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatalf("json error %v", err)
+	}
+	if len(history) != historyMaxLen {
+		t.Fatalf("expected %d events, got %d", historyMaxLen, len(history))
+	}
+	create, update, del := history[historyMaxLen-3], history[historyMaxLen-2], history[historyMaxLen-1]
+	if create.Action != "create" || create.Old != nil || create.New["url"] != "http://someurl" {
+		t.Errorf("invalid create event %+v", create)
+	}
+	if update.Action != "update" || update.Old["url"] != "http://someurl" || update.New["url"] != "http://someotherurl" {
+		t.Errorf("invalid update event %+v", update)
+	}
+	if del.Action != "delete" || del.Old["url"] != "http://someotherurl" || del.New != nil {
+		t.Errorf("invalid delete event %+v", del)
+	}
+	if create.Actor == "" {
+		t.Error("actor wasn't recorded")
+	}
+	if w := testHTTP("GET", "/shorten/qwe345/history", ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
 // PUT
 func TestPUTInvalidURL(t *testing.T) {
 	if w := testHTTP("PUT", "/shorten/", ""); w.Code != http.StatusNotFound {
@@ -264,6 +1134,141 @@ func TestPUTChangeData(t *testing.T) {
 	}
 }
 
+func TestPUTIfMatch(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com",
+		ShortCode: "abc123",
+		Title:     "some title",
+		Version:   2,
+	})
+	put := func(if_match string) *httptest.ResponseRecorder {
+		setupMocks()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PUT", "/shorten/abc123", strings.NewReader(`{"url": "http://somenewurl"}`))
+		req.Header.Set("If-Match", if_match)
+		shorten(w, req)
+		return w
+	}
+	if w := put(`"1"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if mock_db.data[0].URL != "http://someurl.com" {
+		t.Error("stale update shouldn't be stored")
+	}
+	w := put(`"2"`)
+	if w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w.Header().Get("ETag") != `"3"` || mock_db.data[0].Version != 3 {
+		t.Errorf("version wasn't bumped: %s", w.Header().Get("ETag"))
+	}
+	// full replacement, full stored record in response
+	if mock_db.data[0].Title != "" {
+		t.Error("title should be cleared")
+	}
+	if _, err := testResult(w, mock_db.data[0]); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// PATCH
+func TestPATCH(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:          "1",
+		URL:         "http://someurl.com",
+		ShortCode:   "abc123",
+		AccessCount: 3,
+		Version:     1,
+	})
+	patch := func(body, content_type, if_match string) *httptest.ResponseRecorder {
+		setupMocks()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/shorten/abc123", strings.NewReader(body))
+		req.Header.Set("Content-Type", content_type)
+		if if_match != "" {
+			req.Header.Set("If-Match", if_match)
+		}
+		shorten(w, req)
+		return w
+	}
+
+	w := patch(`{"title": "some title", "shortCode": "xyz"}`, "application/merge-patch+json", `"1"`)
+	if w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	record := mock_db.data[0]
+	if record.Title != "some title" || record.URL != "http://someurl.com" || record.ShortCode != "abc123" {
+		t.Errorf("invalid patch result: %v", record)
+	}
+	if record.AccessCount != 3 || record.Version != 2 {
+		t.Errorf("access count should be kept and version bumped: %v", record)
+	}
+	if _, err := testResult(w, record); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// null removes members
+	if w := patch(`{"title": null}`, "", ""); w.Code != http.StatusOK || mock_db.data[0].Title != "" {
+		t.Errorf("title wasn't removed: %v %v", w.Code, mock_db.data[0])
+	}
+	// password protection
+	if w := patch(`{"password": "secret"}`, "", ""); w.Code != http.StatusOK || mock_db.data[0].PasswordHash == "" {
+		t.Errorf("password wasn't set: %v", w.Code)
+	}
+	if w := patch(`{"title": "other title"}`, "", ""); w.Code != http.StatusOK || mock_db.data[0].PasswordHash == "" {
+		t.Errorf("password should be kept: %v", w.Code)
+	}
+	if w := patch(`{"password": null}`, "", ""); w.Code != http.StatusOK || mock_db.data[0].PasswordHash != "" {
+		t.Errorf("password wasn't removed: %v", w.Code)
+	}
+
+	// errors
+	if w := patch(`{"url": null}`, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := patch(`["title"]`, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := patch(`{"title": "x"}`, "text/plain", ""); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := patch(`{"title": "x"}`, "", `"1", W/"6"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := patch(`{"title": "x"}`, "", "*"); w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestStoreRecordConflict(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com",
+		ShortCode: "abc123",
+		Version:   3,
+	})
+	setupMocks()
+	// record changed after it was read
+	stale := mock_db.data[0]
+	stale.Version = 2
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PATCH", "/shorten/abc123", nil)
+	func() {
+		defer recover_hdl(w, r)
+		storeRecord(r, stale, &URLData{URL: "http://somenewurl"})
+	}()
+	if w.Code != http.StatusConflict {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if mock_db.data[0].URL != "http://someurl.com" {
+		t.Error("conflicting update shouldn't be stored")
+	}
+}
+
 // DELETE
 func TestDELETEInvalidURL(t *testing.T) {
 	if w := testHTTP("DELETE", "/shorten/", ""); w.Code != http.StatusNotFound {
@@ -292,7 +1297,223 @@ func TestDELETERemoveRecord(t *testing.T) {
 	if w.Code != http.StatusNoContent {
 		t.Errorf("invalid response code %v", w.Code)
 	}
-	if len(mock_db.data) > 0 {
-		t.Errorf("no records were deleted")
+	if len(mock_db.data) != 1 || !mock_db.data[0].Deleted {
+		t.Errorf("record should be marked deleted")
+	}
+	for _, path := range []string{"/shorten/abc123", "/shorten/abc123/stats"} {
+		if w := testHTTP("GET", path, ""); w.Code != http.StatusGone {
+			t.Errorf("invalid response code %v for %s", w.Code, path)
+		}
+	}
+	w = httptest.NewRecorder()
+	root(http.NotFoundHandler())(w, httptest.NewRequest("GET", "/abc123", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := testHTTP("DELETE", "/shorten/abc123", ""); w.Code != http.StatusGone {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := testHTTP("GET", "/shorten/list", ""); w.Body.String() != "[]" {
+		t.Errorf("deleted record listed: %s", w.Body.String())
+	}
+}
+
+func TestDELETERestore(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data, URLData{
+		ID:        "1",
+		URL:       "http://someurl.com",
+		ShortCode: "abc123",
+	})
+	if w := testHTTP("POST", "/shorten/abc123/restore", ""); w.Code != http.StatusConflict {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	testHTTP("DELETE", "/shorten/abc123", "")
+	mock_db.data[0].AccessCount = 5 // flushed meanwhile
+	if w := testHTTP("POST", "/shorten/abc123/restore", ""); w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if mock_db.data[0].Deleted || !mock_db.data[0].DeletedAt.IsZero() || mock_db.data[0].AccessCount != 5 {
+		t.Errorf("record wasn't restored %+v", mock_db.data[0])
+	}
+	if w := testHTTP("GET", "/shorten/abc123", ""); w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// retention is over
+	testHTTP("DELETE", "/shorten/abc123", "")
+	mock_db.data[0].DeletedAt = time.Now().Add(-delete_retention - time.Minute)
+	if w := testHTTP("POST", "/shorten/abc123/restore", ""); w.Code != http.StatusGone {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	expired := time.Now().Add(-delete_retention - time.Minute)
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "http://someurl.com", ShortCode: "abc123", Deleted: true, DeletedAt: expired},
+		URLData{ID: "2", URL: "http://someotherurl.com", ShortCode: "qwe345", Deleted: true, DeletedAt: time.Now()},
+		URLData{ID: "3", URL: "http://yetanotherurl.com", ShortCode: "zxc678"},
+	)
+	// more than a batch
+	for i := 0; i < purgeBatchLen; i++ {
+		mock_db.data = append(mock_db.data, URLData{URL: "http://someurl.com", ShortCode: fmt.Sprintf("old%d", i), Deleted: true, DeletedAt: expired})
+	}
+	events := &eventCollectionMock{}
+	SetAuditCollection(events)
+	defer SetAuditCollection(nil)
+	setupMocks()
+
+	purgeDeleted(context.Background())
+	if len(mock_db.data) != 2 || mock_db.data[0].ShortCode != "qwe345" {
+		t.Errorf("only expired records should be purged: %v", mock_db.data)
+	}
+	if len(events.events) != purgeBatchLen+1 || events.events[0].Action != "purge" {
+		t.Errorf("purge wasn't recorded: %v", events.events)
+	}
+	// purged code stays reserved
+	if !codeWasUsed(context.Background(), "abc123") || codeWasUsed(context.Background(), "abc124") {
+		t.Error("purged codes should be reserved")
+	}
+}
+
+// mock db restoring a record right after deleted records were listed
+type restoringCollectionMock struct {
+	*dbCollectionMock
+	short_code string
+}
+
+func (collection *restoringCollectionMock) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	err := collection.dbCollectionMock.FindSome(ctx, filter, limit, result)
+	for i := range collection.data {
+		if collection.data[i].ShortCode == collection.short_code {
+			collection.data[i].Deleted = false
+			collection.data[i].DeletedAt = time.Time{}
+		}
+	}
+	return err
+}
+
+func TestPurgeRestored(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	expired := time.Now().Add(-delete_retention - time.Minute)
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "http://someurl.com", ShortCode: "abc123", Deleted: true, DeletedAt: expired},
+		URLData{ID: "2", URL: "http://someotherurl.com", ShortCode: "qwe345", Deleted: true, DeletedAt: expired},
+	)
+	backend_db = &restoringCollectionMock{dbCollectionMock: &mock_db, short_code: "abc123"}
+	defer setupMocks()
+	purgeDeleted(context.Background())
+	if len(mock_db.data) != 1 || mock_db.data[0].ShortCode != "abc123" || mock_db.data[0].Deleted {
+		t.Errorf("restored record shouldn't be purged: %v", mock_db.data)
+	}
+}
+
+// metrics
+func TestRouteOf(t *testing.T) {
+	routes := map[string]string{
+		"/":                     "/",
+		"/js/app.js":            "/",
+		"/metrics":              "/metrics",
+		"/shorten":              "/shorten",
+		"/shorten/list":         "/shorten/list",
+		"/shorten/search":       "/shorten/search",
+		"/campaigns":            "/campaigns",
+		"/campaigns/spring":     "/campaigns/{name}",
+		"/campaigns/spring/x":   "other",
+		"/workspaces":           "/workspaces",
+		"/workspace":            "/workspace",
+		"/workspace/keys":       "/workspace/keys",
+		"/workspace/keys/1":     "/workspace/keys/{id}",
+		"/workspace/x":          "other",
+		"/me/usage":             "/me/usage",
+		"/workspace/users":      "other",
+		"/workspaces/acme/keys": "/workspaces/{name}/keys",
+		"/workspaces/acme/x":    "other",
+		"/auth/login":           "/auth/login",
+		"/auth/other":           "other",
+		"/shorten/abc123":       "/shorten/{code}",
+		"/shorten/abc123/stats": "/shorten/{code}/stats",
+		"/shorten/abc123/qr":    "/shorten/{code}/qr",
+		"/abc123":               "/{code}",
+		"/abc123/more/path":     "/{code}/{path}",
+		"/shorten/abc123/xyz":   "other",
+	}
+	// tests run in the package dir
+	defer func(dir string) { frontendDir = dir }(frontendDir)
+	frontendDir = "../frontend"
+	for path, ref := range routes {
+		req := httptest.NewRequest("GET", path, nil)
+		if route := routeOf(req); route != ref {
+			t.Errorf("invalid route for %s: %s", path, route)
+		}
+	}
+}
+
+// probes
+type pingerMock struct {
+	err error
+}
+
+func (pinger *pingerMock) Ping(ctx context.Context) error {
+	return pinger.err
+}
+
+func TestHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	pinger := &pingerMock{}
+	SetPinger(pinger)
+	defer SetPinger(nil)
+	probe := func() int {
+		w := httptest.NewRecorder()
+		readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	if code := probe(); code != http.StatusOK {
+		t.Errorf("invalid response code %v", code)
+	}
+	// db unreachable
+	pinger.err = fmt.Errorf("connection refused")
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Errorf("invalid response code %v", code)
+	}
+	// shutting down
+	pinger.err = nil
+	shutting_down.Store(true)
+	defer shutting_down.Store(false)
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Errorf("invalid response code %v", code)
+	}
+}
+
+// logging
+func TestErrorRequestID(t *testing.T) {
+	backend_db = &mock_db
+	handler := logging.Middleware(http.HandlerFunc(shorten))
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/shorten/a/b/c", nil)
+	req.Header.Set(logging.RequestIDHeader, "req-42")
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if id := w.Header().Get(logging.RequestIDHeader); id != "req-42" {
+		t.Errorf("invalid request id header %q", id)
+	}
+	var res errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("json error %v", err)
+	}
+	if res.RequestID != "req-42" || res.Error == "" {
+		t.Errorf("invalid error response %+v", res)
 	}
 }
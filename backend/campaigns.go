@@ -0,0 +1,171 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+	"url-shortener/campaign"
+	"url-shortener/db_interface"
+	"url-shortener/url_data"
+)
+
+const campaignListMaxLen int = 100
+const campaignPageLen int = 1000
+
+var backend_campaigns DB
+
+// sets collection storing campaigns. should be called before Start()
+func SetCampaignCollection(collection DB) {
+	backend_campaigns = collection
+}
+
+// click stats of a campaign
+type campaignStats struct {
+	Campaign string       `json:"campaign"`
+	Links    int          `json:"links"`
+	Clicks   int          `json:"clicks"`
+	PerLink  []linkClicks `json:"perLink"`
+}
+
+type linkClicks struct {
+	ShortCode string `json:"shortCode"`
+	ShortURL  string `json:"shortUrl"`
+	URL       string `json:"url"`
+	Clicks    int    `json:"clicks"`
+}
+
+// helpers
+
+func requireCampaigns() {
+	if backend_campaigns == nil {
+		panic(httpErr{
+			code:  http.StatusNotImplemented,
+			descr: "campaigns are not configured"})
+	}
+}
+
+func findCampaign(r *http.Request, name string) campaign.Campaign {
+	requireCampaigns()
+	c := campaign.Campaign{Name: name, Workspace: workspaceOf(r)}
+	handleDBErrors(backend_campaigns.FindOne(r.Context(), c, &c))
+	return c
+}
+
+// merge utm parameters of the link campaign and utm overrides into record url
+func applyCampaign(r *http.Request, record *URLData) {
+	if err := campaign.ValidateUTM(record.UTM); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: err.Error()}) //400
+	}
+	defaults := map[string]string{}
+	if record.Campaign != "" {
+		requireCampaigns()
+		c := campaign.Campaign{Name: record.Campaign, Workspace: workspaceOf(r)}
+		err := backend_campaigns.FindOne(r.Context(), c, &c)
+		if err == db_interface.ErrNoDocuments {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("unknown campaign %q", record.Campaign)}) //400
+		}
+		handleDBErrors(err)
+		defaults = c.UTM()
+	}
+	merged, err := campaign.MergeUTM(record.URL, record.UTM, defaults)
+	if err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: fmt.Sprintf("invalid url: %v", err)}) //400
+	}
+	record.URL = merged
+	record.UTM = nil
+}
+
+func createCampaign(w http.ResponseWriter, r *http.Request) {
+	c := campaign.Campaign{}
+	body := readBody(r)
+	if err := json.Unmarshal(body, &c); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: fmt.Sprintf("Error processing request: %v", err)}) //400
+	}
+	if err := c.Normalize(); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: err.Error()}) //400
+	}
+	c.Workspace = workspaceOf(r)
+	err := backend_campaigns.FindOne(r.Context(), campaign.Campaign{Name: c.Name, Workspace: c.Workspace}, &campaign.Campaign{})
+	if err == nil {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: fmt.Sprintf("campaign %q already exists", c.Name)}) //409
+	} else if err != db_interface.ErrNoDocuments {
+		handleDBErrors(err)
+	}
+	c.CreatedAt = time.Now().UTC()
+	// unique index catches concurrent creation
+	c.ID, err = backend_campaigns.InsertOne(r.Context(), c)
+	handleDBErrors(err)
+	slog.InfoContext(r.Context(), "campaign created", "campaign", c.Name)
+	sendJsonResponse(w, r, http.StatusCreated, c) //201
+}
+
+func listCampaigns(w http.ResponseWriter, r *http.Request) {
+	list := make([]campaign.Campaign, 0, campaignListMaxLen)
+	var filter any
+	if ws := workspaceOf(r); ws != "" {
+		filter = campaign.Campaign{Workspace: ws}
+	}
+	handleDBErrors(backend_campaigns.FindSome(r.Context(), filter, campaignListMaxLen, &list))
+	sendJsonResponse(w, r, http.StatusOK, list)
+}
+
+// aggregate clicks of all links of the campaign, including clicks not flushed yet
+func getCampaignStats(name string, w http.ResponseWriter, r *http.Request) {
+	findCampaign(r, name)
+	filter := url_data.ListFilter{Workspace: workspaceOf(r), Campaign: name, Deleted: url_data.NotDeleted()}
+	stats := campaignStats{
+		Campaign: name,
+		PerLink:  []linkClicks{},
+	}
+	// page by page, campaigns may have any number of links
+	for {
+		records := make([]URLData, 0, campaignPageLen)
+		handleDBErrors(backend_db.FindSorted(r.Context(), filter, "_id", stats.Links, campaignPageLen, &records))
+		for _, record := range records {
+			clicks := record.AccessCount + backend_clicks.Pending(record.Domain, record.ShortCode)
+			record.Redact()
+			stats.Links++
+			stats.Clicks += clicks
+			stats.PerLink = append(stats.PerLink, linkClicks{
+				ShortCode: record.ShortCode,
+				ShortURL:  publicURL(r, record.Domain, record.ShortCode),
+				URL:       record.URL,
+				Clicks:    clicks,
+			})
+		}
+		if len(records) < campaignPageLen {
+			break
+		}
+	}
+	sendJsonResponse(w, r, http.StatusOK, stats)
+}
+
+// handle /campaigns requests
+func campaigns(w http.ResponseWriter, r *http.Request) {
+	defer recover_hdl(w, r)
+	setCachePolicy(w, r)
+	requireCampaigns()
+	r = authenticate(r)
+
+	tokens := tokenizePath(r.URL.Path)
+	switch {
+	case len(tokens) > 3, len(tokens) == 3 && tokens[2] != "stats":
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+	case len(tokens) == 1 && r.Method == "POST":
+		createCampaign(w, r)
+	case r.Method != "GET":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case len(tokens) == 1:
+		listCampaigns(w, r)
+	case len(tokens) == 2:
+		sendJsonResponse(w, r, http.StatusOK, findCampaign(r, tokens[1]))
+	default:
+		getCampaignStats(tokens[1], w, r)
+	}
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"url-shortener/campaign"
+	"url-shortener/db_interface"
+)
+
+// mock campaign collection
+
+type campaignCollectionMock struct {
+	unsupportedCollection
+	campaigns []campaign.Campaign
+}
+
+func (collection *campaignCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(campaign.Campaign)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	t.ID = fmt.Sprintf("%d", len(collection.campaigns))
+	collection.campaigns = append(collection.campaigns, t)
+	return t.ID, nil
+}
+
+func (collection *campaignCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	f, ok := filter.(campaign.Campaign)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	r, ok := result.(*campaign.Campaign)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	for _, c := range collection.campaigns {
+		if c.Name == f.Name && c.Workspace == f.Workspace {
+			*r = c
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func (collection *campaignCollectionMock) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	r, ok := result.(*[]campaign.Campaign)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	f, _ := filter.(campaign.Campaign)
+	*r = (*r)[:0]
+	for _, c := range collection.campaigns {
+		if len(*r) < limit && (f.Workspace == "" || f.Workspace == c.Workspace) {
+			*r = append(*r, c)
+		}
+	}
+	return nil
+}
+
+func TestCampaigns(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	SetCampaignCollection(&campaignCollectionMock{})
+	defer SetCampaignCollection(nil)
+	setupMocks()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		campaigns(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := request("POST", "/campaigns", `{"name": "spring", "utm_source": "newsletter", "utm_medium": "email"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("POST", "/campaigns", `{"name": "spring"}`); w.Code != http.StatusConflict {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("POST", "/campaigns", `{"name": "spring sale"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("GET", "/campaigns/spring", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"utm_campaign":"spring"`) {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/campaigns/autumn", ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("GET", "/campaigns", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"spring"`) {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+
+	// utm parameters are merged into links
+	w = testHTTP("POST", "/shorten", `{"url": "http://someurl.com/?utm_source=site", "campaign": "spring", "utm": {"content": "banner"}}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	expected := "http://someurl.com/?utm_source=site&utm_campaign=spring&utm_content=banner&utm_medium=email"
+	if mock_db.data[0].URL != expected || mock_db.data[0].Campaign != "spring" {
+		t.Errorf("invalid url %s", mock_db.data[0].URL)
+	}
+	testHTTP("POST", "/shorten", `{"url": "http://someotherurl.com", "campaign": "spring"}`)
+	testHTTP("POST", "/shorten", `{"url": "http://yetanotherurl.com"}`)
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl.com", "campaign": "autumn"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := testHTTP("POST", "/shorten", `{"url": "http://someurl.com", "utm": {"id": "1"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// stats include clicks not flushed yet
+	mock_db.data[0].AccessCount = 3
+	mock_db.data[2].AccessCount = 7
+	testHTTP("GET", "/shorten/"+mock_db.data[1].ShortCode, "")
+	w = request("GET", "/campaigns/spring/stats", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	stats := campaignStats{}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Errorf("json error %v", err)
+	}
+	if stats.Links != 2 || stats.Clicks != 4 || len(stats.PerLink) != 2 || stats.PerLink[1].Clicks != 1 {
+		t.Errorf("invalid stats %+v", stats)
+	}
+	backend_clicks.Flush(context.Background())
+
+	// deleted links are left out, links beyond a page are counted
+	mock_db.data[0].Deleted = true
+	for i := 0; i < campaignPageLen; i++ {
+		mock_db.data = append(mock_db.data, URLData{URL: "http://someurl.com", ShortCode: fmt.Sprintf("link%d", i), Campaign: "spring", AccessCount: 1})
+	}
+	stats = campaignStats{}
+	json.Unmarshal(request("GET", "/campaigns/spring/stats", "").Body.Bytes(), &stats)
+	if stats.Links != campaignPageLen+1 || stats.Clicks != campaignPageLen+1 {
+		t.Errorf("invalid stats %d links %d clicks", stats.Links, stats.Clicks)
+	}
+}
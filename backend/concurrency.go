@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/url_data"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// helpers
+
+// strong entity tag of the stored record version
+func recordETag(record URLData) string {
+	return fmt.Sprintf(`"%d"`, record.Version)
+}
+
+func setETag(w http.ResponseWriter, record URLData) {
+	w.Header().Set("ETag", recordETag(record))
+}
+
+// fail with 412 unless If-Match (if any) matches the record
+// weak tags never match, as If-Match requires strong comparison
+func checkIfMatch(r *http.Request, record URLData) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return
+	}
+	etag := recordETag(record)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return
+		}
+	}
+	panic(httpErr{
+		code:  http.StatusPreconditionFailed,
+		descr: fmt.Sprintf("link was modified, current version is %s", etag)})
+}
+
+// store editable fields of record, unless old was changed meanwhile
+// returns the full stored record
+func storeRecord(r *http.Request, old URLData, record *URLData) URLData {
+	// links can't move to another domain, as their code may be taken there
+	if record.Domain != "" && checkDomain(record.Domain) != old.Domain {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: "domain of a link can't be changed"}) //400
+	}
+	record.Domain = old.Domain
+	record.Workspace = old.Workspace
+	record.Owner = old.Owner
+	record.Alias = old.Alias
+	record.Version = old.Version + 1
+	record.Host = hostOf(record.URL)
+	record.UpdatedAt = time.Now()
+	changes := record.Editable()
+	// records stored before versioning have no version and are matched by code only
+	filter := url_data.ByCode(old.Domain, old.ShortCode)
+	filter.Version = old.Version
+	err := backend_db.UpdateOne(r.Context(), filter, &changes)
+	if err == db_interface.ErrNoDocuments {
+		code := http.StatusConflict
+		if r.Header.Get("If-Match") != "" {
+			code = http.StatusPreconditionFailed
+		}
+		panic(httpErr{
+			code:  code,
+			descr: "link was modified concurrently"})
+	}
+	handleDBErrors(err)
+	// re-read, since access count is maintained independently
+	return findRecord(r, old.Domain, old.ShortCode)
+}
+
+// apply RFC 7396 JSON merge patch to target
+func mergePatch(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// apply merge patch from request body to a copy of record
+func patchRecord(r *http.Request, record URLData) URLData {
+	if content_type := r.Header.Get("Content-Type"); content_type != "" {
+		media_type, _, _ := mime.ParseMediaType(content_type)
+		if media_type != mergePatchType && media_type != "application/json" {
+			panic(httpErr{
+				code:  http.StatusUnsupportedMediaType,
+				descr: fmt.Sprintf("unsupported content type %s, use %s", content_type, mergePatchType)}) //415
+		}
+	}
+	var patch map[string]any
+	if err := json.Unmarshal(readBody(r), &patch); err != nil || patch == nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: "patch must be a json object"}) //400
+	}
+	var doc any
+	data, err := json.Marshal(&record)
+	if err == nil {
+		err = json.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Error converting record:\n%v", err))
+	}
+	patched := URLData{}
+	data, _ = json.Marshal(mergePatch(doc, patch))
+	if err := json.Unmarshal(data, &patched); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: fmt.Sprintf("Error processing patch: %v", err)}) //400
+	}
+	// password hash isn't part of json, "password": null removes protection
+	if password, ok := patch["password"]; !ok || password != nil {
+		patched.PasswordHash = record.PasswordHash
+	}
+	protectRecord(&patched)
+	prepareRecord(r, &patched)
+	return patched
+}
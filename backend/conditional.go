@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const noStore = "no-store"
+
+// Cache-Control of successful GET responses by route (see routeOf)
+// link metadata may be a minute stale, like the server-side cache,
+// everything else is revalidated with ETag / Last-Modified on every use
+var cachePolicies = map[string]string{
+	"/shorten/{code}":         "public, max-age=60",
+	"/shorten/{code}/stats":   "no-cache",
+	"/shorten/{code}/history": "private, no-cache",
+	"/shorten/{code}/qr":      "public, max-age=86400", // images only depend on the link and parameters
+	"/shorten/list":           "no-cache",
+	"/shorten/search":         "no-cache",
+	"/{code}":                 "private, no-cache",
+	"/{code}/{path}":          "private, no-cache",
+	"/campaigns":              "no-cache",
+	"/campaigns/{name}":       "no-cache",
+	"/campaigns/{name}/stats": "no-cache",
+	"/workspace":              "private, no-cache",
+	"/workspace/keys":         "private, no-cache",
+	"/me/usage":               "private, no-cache",
+}
+
+// links which need credentials must not end up in shared caches
+const credentialsPolicy = "private, no-store"
+
+// helpers
+
+// set default Cache-Control of the route, handlers may override it
+func setCachePolicy(w http.ResponseWriter, r *http.Request) {
+	policy := noStore
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if p, ok := cachePolicies[routeOf(r)]; ok {
+			policy = p
+		}
+		// responses depend on the api key or session then
+		if backend_workspaces != nil {
+			policy = strings.Replace(policy, "public", "private", 1)
+		}
+	}
+	w.Header().Set("Cache-Control", policy)
+}
+
+// strong entity tag of response body
+func contentETag(body []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+}
+
+func setLastModified(w http.ResponseWriter, t time.Time) {
+	if !t.IsZero() {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// whether conditional GET can be answered with 304, based on response headers
+// If-None-Match takes precedence over If-Modified-Since and uses weak comparison
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if if_none_match := r.Header.Get("If-None-Match"); if_none_match != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(if_none_match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if if_modified_since := r.Header.Get("If-Modified-Since"); if_modified_since != "" {
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		since, err := http.ParseTime(if_modified_since)
+		return err == nil && !modified.After(since)
+	}
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	// 304 has no body
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified) // 304
+}
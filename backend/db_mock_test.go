@@ -1,18 +1,63 @@
 package backend
 
 import (
+	"context"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"url-shortener/audit"
 	"url-shortener/db_interface"
+	"url-shortener/url_data"
 )
 
 // mock db interface
 
+// collection failing every call, embedded by mocks which only support a few
+type unsupportedCollection struct{}
+
+func (unsupportedCollection) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	return "", fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) FindOne(ctx context.Context, filter any, result any) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) UpdateOne(ctx context.Context, filter any, update_with any) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) ReplaceOne(ctx context.Context, filter any, replacement any) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) DeleteOne(ctx context.Context, filter any) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, result any) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	return fmt.Errorf("not supported")
+}
+
+func (unsupportedCollection) Search(ctx context.Context, query string, filter any, limit int, result any) error {
+	return fmt.Errorf("not supported")
+}
+
 type dbCollectionMock struct {
 	data   []URLData
 	id_cnt int
 }
 
-func (collection *dbCollectionMock) InsertOne(doc any) (id string, err error) {
+func (collection *dbCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
 	t, ok := doc.(URLData)
 	if ok {
 		t.ID = fmt.Sprintf("%d", collection.id_cnt)
@@ -23,17 +68,60 @@ func (collection *dbCollectionMock) InsertOne(doc any) (id string, err error) {
 	return "", fmt.Errorf("invalid doc type %T", t)
 }
 
-func (collection *dbCollectionMock) FindOne(filter any, result any) error {
-	f, ok := filter.(URLData)
-	if !ok {
-		return fmt.Errorf("invalid filter type %T", f)
+// predicate of single record filters
+// code filters match code on domain, record filters match url or code (on any domain)
+// value of an optional filter field, nil matches the empty value
+func valueOf(field *string) string {
+	if field == nil {
+		return ""
+	}
+	return *field
+}
+
+// whether flag meets a $ne: true condition
+func unset(c *url_data.Cmp, flag bool) bool {
+	return c == nil || c.Ne != true || !flag
+}
+
+// whether list of length meets an $exists condition on its first element
+func empty(c *url_data.Cmp, length int) bool {
+	return c == nil || c.Exists == nil || *c.Exists == (length > 0)
+}
+
+func matcherOf(filter any) (func(data URLData) bool, error) {
+	switch f := filter.(type) {
+	case url_data.CodeFilter:
+		return func(data URLData) bool {
+			return f.ShortCode == data.ShortCode && f.DomainName() == data.Domain && (f.Version == 0 || f.Version == data.Version)
+		}, nil
+	case url_data.PurgeFilter:
+		return func(data URLData) bool {
+			return f.ShortCode == data.ShortCode && valueOf(f.Domain) == data.Domain &&
+				data.Deleted && data.DeletedAt.Before(f.DeletedAt.Lt.(time.Time))
+		}, nil
+	case url_data.DuplicateFilter:
+		return func(data URLData) bool {
+			return f.URL == data.URL && valueOf(f.Domain) == data.Domain && valueOf(f.Workspace) == data.Workspace &&
+				data.PasswordHash == "" && !data.Deleted &&
+				unset(f.Interstitial, data.Interstitial) && unset(f.SignedOnly, data.SignedOnly) &&
+				unset(f.PassPath, data.PassPath) && unset(f.PassQuery, data.PassQuery) &&
+				unset(f.StickyVariants, data.StickyVariants) && empty(f.Rules, len(data.Rules)) && empty(f.Variants, len(data.Variants))
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid filter type %T", filter)
+}
+
+func (collection *dbCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	matches, err := matcherOf(filter)
+	if err != nil {
+		return err
 	}
 	r, ok := result.(*URLData)
 	if !ok {
 		return fmt.Errorf("invalid result type %T", r)
 	}
 	for _, data := range collection.data {
-		if f.URL == data.URL || f.ShortCode == data.ShortCode {
+		if matches(data) {
 			*r = data
 			return nil
 		}
@@ -42,10 +130,53 @@ func (collection *dbCollectionMock) FindOne(filter any, result any) error {
 }
 
 // update doc
-func (collection *dbCollectionMock) UpdateOne(filter any, update_with any) error {
-	f, ok := filter.(URLData)
-	if !ok {
-		return fmt.Errorf("invalid filter type %T", f)
+func (collection *dbCollectionMock) UpdateOne(ctx context.Context, filter any, update_with any) error {
+	matches, err := matcherOf(filter)
+	if err != nil {
+		return err
+	}
+	if changes, ok := update_with.(*url_data.EditableData); ok {
+		if changes.PasswordHash != nil && *changes.PasswordHash == "" {
+			return fmt.Errorf("removed passwords have to be unset")
+		}
+		for i := range collection.data {
+			data := &collection.data[i]
+			if matches(*data) {
+				data.URL = changes.URL
+				data.Host = changes.Host
+				data.Title = changes.Title
+				data.Description = changes.Description
+				data.Tags = changes.Tags
+				data.Folder = changes.Folder
+				data.Campaign = changes.Campaign
+				data.Interstitial = changes.Interstitial
+				data.SignedOnly = changes.SignedOnly
+				data.PassPath = changes.PassPath
+				data.PassQuery = changes.PassQuery
+				data.QueryConflict = changes.QueryConflict
+				data.Rules = changes.Rules
+				data.Variants = changes.Variants
+				data.StickyVariants = changes.StickyVariants
+				data.PasswordHash = valueOf(changes.PasswordHash)
+				data.UpdatedAt = changes.UpdatedAt
+				data.Version = changes.Version
+				return nil
+			}
+		}
+		return db_interface.ErrNoDocuments
+	}
+	if changes, ok := update_with.(*url_data.RestoreData); ok {
+		for i := range collection.data {
+			data := &collection.data[i]
+			if matches(*data) {
+				data.Deleted = changes.Deleted != nil && *changes.Deleted
+				data.DeletedAt = time.Time{}
+				data.UpdatedAt = changes.UpdatedAt
+				data.Version = changes.Version
+				return nil
+			}
+		}
+		return db_interface.ErrNoDocuments
 	}
 	r, ok := update_with.(*URLData)
 	if !ok {
@@ -59,6 +190,24 @@ func (collection *dbCollectionMock) UpdateOne(filter any, update_with any) error
 		if second.ShortCode != "" {
 			first.ShortCode = second.ShortCode
 		}
+		if second.Title != "" {
+			first.Title = second.Title
+		}
+		if second.Description != "" {
+			first.Description = second.Description
+		}
+		if second.Tags != nil {
+			first.Tags = second.Tags
+		}
+		if second.Folder != "" {
+			first.Folder = second.Folder
+		}
+		if second.Interstitial {
+			first.Interstitial = second.Interstitial
+		}
+		if second.PasswordHash != "" {
+			first.PasswordHash = second.PasswordHash
+		}
 		if second.ID != "" {
 			first.ID = second.ID
 		}
@@ -71,11 +220,18 @@ func (collection *dbCollectionMock) UpdateOne(filter any, update_with any) error
 		if second.AccessCount != 0 {
 			first.AccessCount = second.AccessCount
 		}
+		if second.Version != 0 {
+			first.Version = second.Version
+		}
+		if second.Deleted {
+			first.Deleted = second.Deleted
+			first.DeletedAt = second.DeletedAt
+		}
 	}
 
 	for i := range collection.data {
 		data := &collection.data[i]
-		if f.URL == data.URL || f.ShortCode == data.ShortCode {
+		if matches(*data) {
 			update(data, r)
 			update(r, data)
 			return nil
@@ -84,14 +240,35 @@ func (collection *dbCollectionMock) UpdateOne(filter any, update_with any) error
 	return db_interface.ErrNoDocuments
 }
 
-// delete doc
-func (collection *dbCollectionMock) DeleteOne(filter any) error {
-	f, ok := filter.(URLData)
+// replace doc
+func (collection *dbCollectionMock) ReplaceOne(ctx context.Context, filter any, replacement any) error {
+	matches, err := matcherOf(filter)
+	if err != nil {
+		return err
+	}
+	r, ok := replacement.(URLData)
 	if !ok {
-		return fmt.Errorf("invalid filter type %T", f)
+		return fmt.Errorf("invalid replacement type %T", r)
+	}
+	for i := range collection.data {
+		data := &collection.data[i]
+		if matches(*data) {
+			r.ID = data.ID
+			*data = r
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+// delete doc
+func (collection *dbCollectionMock) DeleteOne(ctx context.Context, filter any) error {
+	matches, err := matcherOf(filter)
+	if err != nil {
+		return err
 	}
 	for i, data := range collection.data {
-		if f.URL == data.URL || f.ShortCode == data.ShortCode {
+		if matches(data) {
 			temp := collection.data[i+1:]                      // save everything after i
 			collection.data = collection.data[:i]              // truncate until i
 			collection.data = append(collection.data, temp...) // concatenate
@@ -102,12 +279,151 @@ func (collection *dbCollectionMock) DeleteOne(filter any) error {
 }
 
 // find some records
-func (collection *dbCollectionMock) FindSome(limit int, result any) error {
-	f, ok := result.(*[]URLData)
+func (collection *dbCollectionMock) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	return collection.FindSorted(ctx, filter, "_id", 0, limit, result)
+}
+
+// only insertion order is supported
+func (collection *dbCollectionMock) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, result any) error {
+	r, ok := result.(*[]URLData)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", r)
+	}
+	if sort != "_id" {
+		return fmt.Errorf("unsupported sort %s", sort)
+	}
+	matches := func(data URLData) bool {
+		switch f := filter.(type) {
+		case url_data.ListFilter:
+			return (f.Tag == "" || slices.Contains(data.Tags, f.Tag)) && (f.Folder == "" || f.Folder == data.Folder) &&
+				(f.Workspace == "" || f.Workspace == data.Workspace) && (f.Deleted == nil || !data.Deleted) &&
+				(f.Campaign == "" || f.Campaign == data.Campaign)
+		case url_data.DeletedFilter:
+			return data.Deleted && data.DeletedAt.Before(f.DeletedAt.Lt.(time.Time))
+		}
+		return true
+	}
+	*r = []URLData{}
+	for _, data := range collection.data {
+		if !matches(data) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+		} else if len(*r) < limit {
+			*r = append(*r, data)
+		}
+	}
+	return nil
+}
+
+// increment field
+func (collection *dbCollectionMock) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	matches, err := matcherOf(filter)
+	if err != nil {
+		return err
+	}
+	variant, is_variant := strings.CutPrefix(field, "variantClicks.")
+	if field != "accessCount" && !is_variant {
+		return fmt.Errorf("unsupported field %s", field)
+	}
+	for i := range collection.data {
+		data := &collection.data[i]
+		if matches(*data) {
+			if !is_variant {
+				data.AccessCount += by
+			} else {
+				if data.VariantClicks == nil {
+					data.VariantClicks = map[string]int{}
+				}
+				data.VariantClicks[variant] += by
+			}
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+// full-text search, backed by in-process inverted index
+func (collection *dbCollectionMock) Search(ctx context.Context, query string, filter any, limit int, result any) error {
+	r, ok := result.(*[]URLData)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", r)
+	}
+	f, ok := filter.(url_data.ListFilter)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	index := newSearchIndex()
+	for i, data := range collection.data {
+		if (f.Workspace != "" && f.Workspace != data.Workspace) || (f.Deleted != nil && data.Deleted) {
+			continue
+		}
+		id := fmt.Sprintf("%d", i)
+		index.Add(id, data.Title, float64(url_data.SearchWeights["title"]))
+		index.Add(id, strings.Join(data.Tags, " "), float64(url_data.SearchWeights["tags"]))
+		index.Add(id, data.Host, float64(url_data.SearchWeights["host"]))
+		index.Add(id, data.URL, float64(url_data.SearchWeights["url"]))
+	}
+	*r = (*r)[:0]
+	for _, id := range index.Search(query, limit) {
+		var i int
+		fmt.Sscan(id, &i)
+		*r = append(*r, collection.data[i])
+	}
+	return nil
+}
+
+// mock audit collection
+
+type eventCollectionMock struct {
+	unsupportedCollection
+	events []audit.Event
+}
+
+func (collection *eventCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(audit.Event)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	t.ID = fmt.Sprintf("%d", len(collection.events))
+	collection.events = append(collection.events, t)
+	return t.ID, nil
+}
+
+func (collection *eventCollectionMock) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	f, ok := filter.(audit.Event)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	r, ok := result.(*[]audit.Event)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	*r = (*r)[:0]
+	for _, event := range collection.events {
+		if event.ShortCode == f.ShortCode && len(*r) < limit {
+			*r = append(*r, event)
+		}
+	}
+	return nil
+}
+
+// only latest first is supported
+func (collection *eventCollectionMock) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, result any) error {
+	f, ok := filter.(audit.HistoryFilter)
+	if !ok || sort != "-at" {
+		return fmt.Errorf("invalid filter type %T or sort %s", filter, sort)
+	}
+	r, ok := result.(*[]audit.Event)
 	if !ok {
-		return fmt.Errorf("invalid result type %T", f)
+		return fmt.Errorf("invalid result type %T", result)
 	}
-	lim := min(limit, cap(collection.data))
-	*f = collection.data[:lim]
+	matching := slices.DeleteFunc(slices.Clone(collection.events), func(event audit.Event) bool {
+		return event.ShortCode != f.ShortCode || (f.Domain == nil) != (event.Domain == "") ||
+			(f.Domain != nil && *f.Domain != event.Domain) || (f.Workspace != "" && f.Workspace != event.Workspace)
+	})
+	slices.SortStableFunc(matching, func(a, b audit.Event) int { return b.At.Compare(a.At) })
+	*r = matching[min(skip, len(matching)):min(skip+limit, len(matching))]
 	return nil
 }
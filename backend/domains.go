@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// short domains, the first one is the default
+var backend_domains []string
+
+// sets short domains links can be created on, the first one is the default
+// without domains, short urls use the host of the request. should be called before Start()
+func SetDomains(domains []string) {
+	backend_domains = nil
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			backend_domains = append(backend_domains, domain)
+		}
+	}
+}
+
+// helpers
+
+// lowercase host without port
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// domain short codes of request are resolved on, empty for the default one
+// hosts which aren't configured domains resolve on the default domain
+func domainOf(r *http.Request) string {
+	host := forwarded(r, "X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	host = hostName(host)
+	if len(backend_domains) == 0 || host == backend_domains[0] || !slices.Contains(backend_domains, host) {
+		return ""
+	}
+	return host
+}
+
+// domain an api request refers to, ?domain= if set, otherwise its Host
+// or the custom domain of the caller's workspace, unless it was removed from the configured domains
+func apiDomainOf(r *http.Request) string {
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		return checkDomain(domain)
+	}
+	if domain := domainOf(r); domain != "" {
+		return domain
+	}
+	if t := tenantOf(r); t != nil && t.workspace.Domain != "" {
+		if !slices.Contains(backend_domains, t.workspace.Domain) {
+			slog.WarnContext(r.Context(), "workspace domain isn't configured, using the default domain",
+				"workspace", t.workspace.Name, "domain", t.workspace.Domain)
+			return ""
+		}
+		return checkDomain(t.workspace.Domain)
+	}
+	return ""
+}
+
+// stored form of domain, empty for the default one
+// fails with 400 unless domain is configured
+func checkDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if !slices.Contains(backend_domains, domain) {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("unknown domain %q", domain)}) //400
+	}
+	if domain == backend_domains[0] {
+		return ""
+	}
+	return domain
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDomains(t *testing.T) {
+	SetDomains([]string{"go.acme.io", " Acme.link "})
+	defer SetDomains(nil)
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "http://someurl.com/default", ShortCode: "abc123", Version: 1},
+		URLData{ID: "2", URL: "http://someurl.com/link", ShortCode: "abc123", Domain: "acme.link", Version: 1},
+	)
+	setupMocks()
+	request := func(method, host, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Host = host
+		if strings.HasPrefix(path, "/shorten") {
+			shorten(w, r)
+		} else {
+			root(http.NotFoundHandler())(w, r)
+		}
+		return w
+	}
+	// same code resolves per Host, unknown hosts resolve on the default domain
+	locations := map[string]string{
+		"go.acme.io":      "http://someurl.com/default",
+		"GO.ACME.IO:8080": "http://someurl.com/default",
+		"acme.link":       "http://someurl.com/link",
+		"localhost:8080":  "http://someurl.com/default",
+	}
+	for host, ref := range locations {
+		if w := request("GET", host, "/abc123", ""); w.Header().Get("Location") != ref {
+			t.Errorf("invalid location %s on %s", w.Header().Get("Location"), host)
+		}
+	}
+	// forwarded host only picks the domain behind a trusted proxy
+	for trust, ref := range map[bool]string{false: "http://someurl.com/default", true: "http://someurl.com/link"} {
+		SetTrustProxy(trust)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/abc123", nil)
+		r.Header.Set("X-Forwarded-Host", "acme.link")
+		root(http.NotFoundHandler())(w, r)
+		if w.Header().Get("Location") != ref {
+			t.Errorf("invalid location %s, trusted proxy %v", w.Header().Get("Location"), trust)
+		}
+	}
+	SetTrustProxy(false)
+	backend_clicks.Flush(context.Background())
+	// api picks domain by ?domain= or Host and returns full short urls
+	lookups := map[string]string{
+		"/shorten/abc123":                        "http://go.acme.io/abc123",
+		"/shorten/abc123?domain=acme.link":       "http://acme.link/abc123",
+		"/shorten/abc123/stats?domain=ACME.link": "http://acme.link/abc123",
+	}
+	for path, ref := range lookups {
+		w := request("GET", "localhost", path, "")
+		result := URLData{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if w.Code != http.StatusOK || result.ShortURL != ref {
+			t.Errorf("invalid response %v %s for %s", w.Code, w.Body.String(), path)
+		}
+	}
+	if w := request("GET", "acme.link", "/shorten/abc123", ""); !strings.Contains(w.Body.String(), `"domain":"acme.link"`) {
+		t.Errorf("invalid response %s", w.Body.String())
+	}
+	if w := request("GET", "localhost", "/shorten/abc123?domain=other.io", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// creation on the domain of the body, ?domain= or Host
+	for _, c := range []struct{ host, path, body, domain string }{
+		{"localhost", "/shorten", `{"url": "http://someurl.com/a"}`, ""},
+		{"acme.link", "/shorten", `{"url": "http://someurl.com/b"}`, "acme.link"},
+		{"localhost", "/shorten?domain=acme.link", `{"url": "http://someurl.com/c"}`, "acme.link"},
+		{"localhost", "/shorten", `{"url": "http://someurl.com/d", "domain": "go.acme.io"}`, ""},
+		{"localhost", "/shorten", `{"url": "http://someurl.com/default", "domain": "acme.link"}`, "acme.link"},
+	} {
+		w := request("POST", c.host, c.path, c.body)
+		result := URLData{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if w.Code != http.StatusCreated {
+			t.Errorf("invalid response code %v for %s", w.Code, c.body)
+			continue
+		}
+		stored := mock_db.data[len(mock_db.data)-1]
+		if stored.Domain != c.domain || result.ShortURL != publicURL(httptest.NewRequest("GET", "/", nil), c.domain, stored.ShortCode) {
+			t.Errorf("invalid domain %q of %s", stored.Domain, w.Body.String())
+		}
+	}
+	// existing links are only shared on their own domain
+	if w := request("POST", "localhost", "/shorten", `{"url": "http://someurl.com/default"}`); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `"shortCode":"abc123"`) || strings.Contains(w.Body.String(), "acme.link") {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if w := request("POST", "localhost", "/shorten", `{"url": "http://someurl.com/e", "domain": "other.io"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// links stay on their domain
+	if w := request("PATCH", "localhost", "/shorten/abc123", `{"domain": "acme.link"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("PATCH", "localhost", "/shorten/abc123?domain=acme.link", `{"title": "Link", "domain": "acme.link"}`); w.Code != http.StatusOK {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if mock_db.data[0].Title != "" || mock_db.data[1].Title != "Link" {
+		t.Error("patch applied to the wrong domain")
+	}
+}
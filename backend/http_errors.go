@@ -1,6 +1,36 @@
 package backend
 
+import (
+	"encoding/json"
+	"net/http"
+	"url-shortener/logging"
+)
+
 type httpErr struct {
 	code  int
 	descr string
+	quota *quotaExceeded // details of exceeded quotas, if that's the cause
+}
+
+// json error body
+type errorResponse struct {
+	Error     string         `json:"error"`
+	Quota     *quotaExceeded `json:"quota,omitempty"`
+	RequestID string         `json:"requestId,omitempty"`
+}
+
+// reply with json error (mirrors http.Error)
+func httpError(w http.ResponseWriter, r *http.Request, descr string, code int) {
+	sendError(w, r, errorResponse{Error: descr}, code)
+}
+
+// reply with json error body
+func sendError(w http.ResponseWriter, r *http.Request, response errorResponse, code int) {
+	response.RequestID = logging.RequestID(r.Context())
+	body, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", noStore)
+	w.WriteHeader(code)
+	w.Write(body)
 }
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"url-shortener/url_data"
+)
+
+const maxTags int = 20
+const maxLabelLen int = 64
+const maxDescriptionLen int = 1024
+
+// helpers
+
+// trim labels, drop empty and duplicate tags
+// fails with 400 on too many or too long labels
+func normalizeLabels(record *URLData) {
+	tags := make([]string, 0, len(record.Tags))
+	seen := map[string]bool{}
+	for _, tag := range record.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxLabelLen {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("tag %q is longer than %d characters", tag, maxLabelLen)})
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("too many tags, at most %d allowed", maxTags)})
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	record.Tags = tags
+	// folders are paths like "marketing/2024"
+	record.Folder = strings.Trim(strings.TrimSpace(record.Folder), "/")
+	if len(record.Folder) > maxLabelLen {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("folder is longer than %d characters", maxLabelLen)})
+	}
+	record.Description = strings.TrimSpace(record.Description)
+	if len(record.Description) > maxDescriptionLen {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("description is longer than %d characters", maxDescriptionLen)})
+	}
+}
+
+// list filter from ?tag= and ?folder= query parameters, within the caller's workspace
+func listFilterOf(r *http.Request) url_data.ListFilter {
+	query := r.URL.Query()
+	return url_data.ListFilter{
+		Workspace: workspaceOf(r),
+		Tag:       strings.TrimSpace(query.Get("tag")),
+		Folder:    strings.Trim(strings.TrimSpace(query.Get("folder")), "/"),
+		Deleted:   url_data.NotDeleted(),
+	}
+}
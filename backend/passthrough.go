@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"url-shortener/url_data"
+)
+
+// query parameters consumed by the shortener itself, never passed through
+var reservedParams = []string{"preview", "continue", "exp", "sig"}
+
+// helpers
+
+// fail with 400 on unknown conflict rule
+func checkPassthrough(record *URLData) {
+	switch record.QueryConflict {
+	case "", url_data.QueryKeepDestination, url_data.QueryOverride, url_data.QueryAppend:
+	default:
+		panic(httpErr{
+			code: http.StatusBadRequest,
+			descr: fmt.Sprintf("invalid queryConflict %q, expected %s, %s or %s", record.QueryConflict,
+				url_data.QueryKeepDestination, url_data.QueryOverride, url_data.QueryAppend)}) //400
+	}
+}
+
+// fail with 404 on dot segments (escaped or not) in path suffix, which would leave the destination path
+func checkSuffix(r *http.Request, suffix string) {
+	for _, segment := range strings.Split(suffix, "/") {
+		if s, err := url.PathUnescape(segment); err != nil || s == "." || s == ".." {
+			panic(httpErr{
+				code:  http.StatusNotFound,
+				descr: fmt.Sprintf("Not found %s", r.URL.Path)}) //404
+		}
+	}
+}
+
+// destination of record for a short url with (escaped) path suffix and query
+// suffix and query are dropped unless the record passes them through
+func destinationOf(record URLData, suffix string, query url.Values) string {
+	if !record.PassPath && !record.PassQuery {
+		return record.URL
+	}
+	u, err := url.Parse(record.URL)
+	if err != nil {
+		return record.URL
+	}
+	if record.PassPath && suffix != "" {
+		// dot segments were rejected by checkSuffix
+		u = u.JoinPath(suffix)
+	}
+	if record.PassQuery {
+		passQuery(u, query, record.QueryConflict)
+	}
+	return u.String()
+}
+
+// add incoming query parameters to u according to conflict rule
+// destination query is kept as is, unless passed parameters override some of it
+func passQuery(u *url.URL, incoming url.Values, conflict string) {
+	dest := u.Query()
+	extra := url.Values{}
+	replace := false
+	for key, values := range incoming {
+		if slices.Contains(reservedParams, key) {
+			continue
+		}
+		if !dest.Has(key) {
+			extra[key] = values
+			continue
+		}
+		switch conflict {
+		case url_data.QueryOverride:
+			dest[key] = values
+			replace = true
+		case url_data.QueryAppend:
+			extra[key] = values
+		}
+	}
+	if replace {
+		u.RawQuery = dest.Encode()
+	}
+	if len(extra) > 0 {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += extra.Encode()
+	}
+}
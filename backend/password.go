@@ -0,0 +1,163 @@
+package backend
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const linkPasswordHeader = "X-Link-Password"
+const maxPasswordFailures int = 5
+const passwordLockout = 15 * time.Minute
+
+// failed password attempts of a client for a link
+type lockoutEntry struct {
+	failures int
+	last     time.Time // last failure
+	until    time.Time // locked until
+}
+
+// whether failures and lockout of entry are over, entries expire a lockout period after their last failure
+func (entry *lockoutEntry) expired(now time.Time, period time.Duration) bool {
+	return now.After(entry.last.Add(period))
+}
+
+// tracks failed password attempts, locks out after max failures
+type lockout struct {
+	mutex   sync.Mutex
+	entries map[string]*lockoutEntry
+	max     int
+	period  time.Duration
+}
+
+var password_lockout = &lockout{
+	entries: make(map[string]*lockoutEntry),
+	max:     maxPasswordFailures,
+	period:  passwordLockout,
+}
+
+// lockout methods
+
+// remaining lockout time of key, 0 if not locked
+func (l *lockout) locked(key string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if entry, ok := l.entries[key]; ok {
+		return time.Until(entry.until).Round(time.Second)
+	}
+	return 0
+}
+
+// register failure of key
+func (l *lockout) fail(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	entry, ok := l.entries[key]
+	if !ok || entry.expired(now, l.period) {
+		l.prune(now)
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	}
+	entry.failures++
+	entry.last = now
+	if entry.failures >= l.max {
+		entry.failures = 0
+		entry.until = now.Add(l.period)
+	}
+}
+
+// forget failures of key
+func (l *lockout) reset(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.entries, key)
+}
+
+// drop expired failures and lockouts, mutex must be held
+func (l *lockout) prune(now time.Time) {
+	for key, entry := range l.entries {
+		if entry.expired(now, l.period) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// helpers
+
+// client address without port
+// behind a trusted proxy, the right-most X-Forwarded-For hop which isn't the proxy itself
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trust_proxy {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if ip := net.ParseIP(strings.TrimSpace(hops[i])); ip != nil && ip.String() != host {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// hash link password received via api
+func hashPassword(password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("invalid password: %v", err)})
+	}
+	return string(hash)
+}
+
+// replace plain password of record with its hash
+func protectRecord(record *URLData) {
+	if record.Password != "" {
+		record.PasswordHash = hashPassword(record.Password)
+		record.Password = ""
+	}
+}
+
+// check password of protected record
+// returns http error describing the failure, nil on success
+func checkLinkPassword(r *http.Request, record URLData, password string) *httpErr {
+	key := record.Domain + "/" + record.ShortCode + "|" + clientIP(r)
+	if remaining := password_lockout.locked(key); remaining > 0 {
+		return &httpErr{
+			code:  http.StatusTooManyRequests,
+			descr: fmt.Sprintf("too many failed attempts, try again in %v", remaining)}
+	}
+	if password == "" {
+		return &httpErr{
+			code:  http.StatusUnauthorized,
+			descr: "password required"}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(record.PasswordHash), []byte(password)) != nil {
+		password_lockout.fail(key)
+		return &httpErr{
+			code:  http.StatusUnauthorized,
+			descr: "wrong password"}
+	}
+	password_lockout.reset(key)
+	return nil
+}
+
+// require password of protected record in X-Link-Password header (api requests)
+func requireLinkPassword(r *http.Request, record URLData) {
+	if record.PasswordHash == "" {
+		return
+	}
+	if err := checkLinkPassword(r, record, r.Header.Get(linkPasswordHeader)); err != nil {
+		panic(*err)
+	}
+}
@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"url-shortener/url_data"
+)
+
+// public base url of the service, e.g. https://sho.rt (may have a path)
+var public_url *url.URL
+
+// whether X-Forwarded-Proto/Host are honored
+var trust_proxy bool
+
+// sets public base url of short links and api links. should be called before Start()
+// without it, scheme and host are taken from the request (or X-Forwarded-Proto/Host behind a trusted proxy)
+func SetPublicURL(base string) error {
+	if base == "" {
+		public_url = nil
+		return nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(base, "/"))
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("invalid public url %q, expected http(s)://host[/path]", base)
+	}
+	public_url = u
+	return nil
+}
+
+// sets whether forwarding headers are honored, only enable it behind a proxy which sets them.
+// should be called before Start()
+func SetTrustProxy(trust bool) {
+	trust_proxy = trust
+}
+
+// helpers
+
+// first value of a (possibly repeated) forwarding header, empty unless the proxy is trusted
+func forwarded(r *http.Request, header string) string {
+	if !trust_proxy {
+		return ""
+	}
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+// scheme clients reached us with
+func schemeOf(r *http.Request) string {
+	if public_url != nil {
+		return public_url.Scheme
+	}
+	if proto := strings.ToLower(forwarded(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// base url clients reached us with, without trailing slash
+func baseURLOf(r *http.Request) string {
+	if public_url != nil {
+		return public_url.String()
+	}
+	host := forwarded(r, "X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return schemeOf(r) + "://" + host
+}
+
+// public url of a short code on domain
+func publicURL(r *http.Request, domain string, short_code string) string {
+	base := baseURLOf(r)
+	switch {
+	case domain != "":
+		base = schemeOf(r) + "://" + domain
+	case public_url == nil && len(backend_domains) > 0:
+		base = schemeOf(r) + "://" + backend_domains[0]
+	}
+	return base + "/" + url.PathEscape(short_code)
+}
+
+// api urls of record
+func apiLinksOf(r *http.Request, domain string, short_code string) *url_data.Links {
+	self := baseURLOf(r) + "/shorten/" + url.PathEscape(short_code)
+	query := ""
+	if domain != "" {
+		query = "?domain=" + url.QueryEscape(domain)
+	}
+	return &url_data.Links{
+		Self:    self + query,
+		Stats:   self + "/stats" + query,
+		QR:      self + "/qr" + query,
+		History: self + "/history" + query,
+	}
+}
+
+// fill in computed fields of record for responses
+func presentRecord(r *http.Request, record *URLData) {
+	if record.ShortCode == "" {
+		return
+	}
+	record.ShortURL = publicURL(r, record.Domain, record.ShortCode)
+	record.Links = apiLinksOf(r, record.Domain, record.ShortCode)
+	if record.Domain == "" && len(backend_domains) > 0 {
+		record.Domain = backend_domains[0]
+	}
+}
@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"url-shortener/url_data"
+)
+
+func TestPublicURL(t *testing.T) {
+	mock_db.data = mock_db.data[:0] //clear data
+	mock_db.data = append(mock_db.data,
+		URLData{ID: "1", URL: "http://someurl.com", ShortCode: "abc123"},
+		URLData{ID: "2", URL: "http://someurl.com", ShortCode: "abc123", Domain: "acme.link"},
+	)
+	setupMocks()
+	get := func(path string, headers map[string]string) URLData {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		shorten(w, r)
+		result := URLData{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("invalid response %v %s", w.Code, w.Body.String())
+		}
+		return result
+	}
+	// request host
+	result := get("/shorten/abc123", nil)
+	if result.ShortURL != "http://example.com/abc123" {
+		t.Errorf("invalid short url %s", result.ShortURL)
+	}
+	ref := url_data.Links{
+		Self:    "http://example.com/shorten/abc123",
+		Stats:   "http://example.com/shorten/abc123/stats",
+		QR:      "http://example.com/shorten/abc123/qr",
+		History: "http://example.com/shorten/abc123/history",
+	}
+	if result.Links == nil || *result.Links != ref {
+		t.Errorf("invalid links %v", result.Links)
+	}
+	// forwarding headers are ignored unless the proxy is trusted
+	result = get("/shorten/abc123", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "sho.rt"})
+	if result.ShortURL != "http://example.com/abc123" {
+		t.Errorf("invalid short url %s", result.ShortURL)
+	}
+	// behind a trusted proxy
+	SetTrustProxy(true)
+	defer SetTrustProxy(false)
+	result = get("/shorten/abc123", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "sho.rt, proxy.local"})
+	if result.ShortURL != "https://sho.rt/abc123" || result.Links.Stats != "https://sho.rt/shorten/abc123/stats" {
+		t.Errorf("invalid urls %s %v", result.ShortURL, result.Links)
+	}
+	// configured base url wins
+	if err := SetPublicURL("https://go.example.com/s/"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPublicURL("")
+	result = get("/shorten/abc123", map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "sho.rt"})
+	if result.ShortURL != "https://go.example.com/s/abc123" || result.Links.Self != "https://go.example.com/s/shorten/abc123" {
+		t.Errorf("invalid urls %s %v", result.ShortURL, result.Links)
+	}
+	// links of other domains
+	SetDomains([]string{"go.example.com", "acme.link"})
+	defer SetDomains(nil)
+	result = get("/shorten/abc123?domain=acme.link", nil)
+	if result.ShortURL != "https://acme.link/abc123" || result.Links.QR != "https://go.example.com/s/shorten/abc123/qr?domain=acme.link" {
+		t.Errorf("invalid urls %s %v", result.ShortURL, result.Links)
+	}
+	for _, base := range []string{"ftp://sho.rt", "sho.rt", "https://sho.rt/?a=1"} {
+		if err := SetPublicURL(base); err == nil {
+			t.Errorf("invalid public url %s accepted", base)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/abc123", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r.Header.Add("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	r.Header.Add("X-Forwarded-For", "10.0.0.1")
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("forwarded address %s used without trusted proxy", ip)
+	}
+	SetTrustProxy(true)
+	defer SetTrustProxy(false)
+	// client set hops on the left can't be trusted
+	if ip := clientIP(r); ip != "198.51.100.7" {
+		t.Errorf("invalid client address %s", ip)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("invalid client address %s", ip)
+	}
+}
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"url-shortener/qr_generator"
+)
+
+const qrDefaultSize int = 256
+const qrDefaultFormat string = "png"
+const qrDefaultECC string = "M"
+
+// serve qr code of short link
+// query: format=png|svg, size=<pixels>, ecc=L|M|Q|H
+func getQR(short_code string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = qrDefaultFormat
+	}
+	content_type := qr_generator.ContentType(format)
+	if content_type == "" {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("invalid format %q, expected png or svg", format)})
+	}
+	size := qrDefaultSize
+	if s := query.Get("size"); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("invalid size %q", s)})
+		}
+	}
+	ecc := strings.ToUpper(query.Get("ecc"))
+	if ecc == "" {
+		ecc = qrDefaultECC
+	}
+	if err := qr_generator.Validate(size, ecc); err != nil {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: err.Error()})
+	}
+	// make sure short code exists
+	record := findRecord(r, apiDomainOf(r), short_code)
+
+	// image only depends on the link and the parameters
+	content := publicURL(r, record.Domain, short_code)
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s", content, format, size, ecc))))
+	w.Header().Set("ETag", etag)
+	if notModified(r, w.Header()) {
+		writeNotModified(w)
+		return
+	}
+	image, err := qr_generator.Generate(content, format, size, ecc)
+	if err != nil {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: err.Error()})
+	}
+	w.Header().Set("Content-Type", content_type)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.%s"`, short_code, format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(image)
+}
@@ -0,0 +1,203 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/workspace"
+)
+
+var backend_usage DB
+
+// sets collection of usage counters, which turns quotas of workspaces and their users on
+// should be called before Start()
+func SetUsageCollection(collection DB) {
+	backend_usage = collection
+}
+
+// exceeded quotas, part of the error body
+type quotaExceeded struct {
+	Scope  string            `json:"scope"` // workspace or user
+	Limits []workspace.Limit `json:"limits"`
+}
+
+// usage of a workspace or user along with its quotas
+type usageReport struct {
+	Links        int              `json:"links"`
+	MonthlyLinks int              `json:"monthlyLinks"`
+	Aliases      int              `json:"aliases"`
+	Quotas       workspace.Quotas `json:"quotas"`
+}
+
+type meUsage struct {
+	Workspace      string       `json:"workspace"`
+	User           string       `json:"user,omitempty"`
+	Month          string       `json:"month"`
+	WorkspaceUsage usageReport  `json:"workspaceUsage"`
+	UserUsage      *usageReport `json:"userUsage,omitempty"`
+}
+
+// counters quotas apply to
+type usageScope struct {
+	name   string
+	key    string
+	quotas workspace.Quotas
+}
+
+// helpers
+
+// usage counters of record: its workspace, and its owner within the workspace
+func usageScopesOf(ws workspace.Workspace, owner string) []usageScope {
+	scopes := []usageScope{{"workspace", workspace.UsageKey(ws.Name, ""), ws.Quotas}}
+	if owner != "" {
+		scopes = append(scopes, usageScope{"user", workspace.UsageKey(ws.Name, owner), ws.UserQuotas})
+	}
+	return scopes
+}
+
+// counter fields changed along with record
+func usageFieldsOf(record URLData, month string) []string {
+	fields := []string{"links"}
+	if record.Alias {
+		fields = append(fields, "aliases")
+	}
+	if month != "" {
+		fields = append(fields, "monthly."+month)
+	}
+	return fields
+}
+
+// add by to counter fields of key, creating its doc on first use
+func addUsage(ctx context.Context, key string, fields []string, by int) error {
+	filter := workspace.Usage{Key: key}
+	for _, field := range fields {
+		err := backend_usage.IncrementOne(ctx, filter, field, by)
+		if err == db_interface.ErrNoDocuments {
+			// unique index resolves concurrent creation
+			_, err = backend_usage.InsertOne(ctx, filter)
+			if err == nil || err == db_interface.ErrDuplicateKey {
+				err = backend_usage.IncrementOne(ctx, filter, field, by)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// current counters of key, zero if there are none yet
+func findUsage(ctx context.Context, key string) workspace.Usage {
+	usage := workspace.Usage{}
+	err := backend_usage.FindOne(ctx, workspace.Usage{Key: key}, &usage)
+	if err != nil && err != db_interface.ErrNoDocuments {
+		handleDBErrors(err)
+	}
+	return usage
+}
+
+// count new (created) or restored record against the quotas of the caller's workspace and record owner
+// counters are bumped first and rolled back when a quota is exceeded, so concurrent
+// requests never overshoot (though at the limit both may fail). fails with 403
+// returns func rolling the reservation back, if storing the record fails
+func reserveUsage(r *http.Request, record URLData, created bool) func() {
+	t := tenantOf(r)
+	if backend_usage == nil || t == nil {
+		return func() {}
+	}
+	month := workspace.Month(time.Now())
+	fields := usageFieldsOf(record, "")
+	if created {
+		fields = usageFieldsOf(record, month)
+	}
+	var reserved []string
+	release := func() {
+		for _, key := range reserved {
+			if err := addUsage(context.WithoutCancel(r.Context()), key, fields, -1); err != nil {
+				slog.ErrorContext(r.Context(), "couldn't release usage", "key", key, "error", err)
+			}
+		}
+	}
+	for _, scope := range usageScopesOf(t.workspace, record.Owner) {
+		if err := addUsage(r.Context(), scope.key, fields, 1); err != nil {
+			release()
+			handleDBErrors(err)
+		}
+		reserved = append(reserved, scope.key)
+		usage := findUsage(r.Context(), scope.key)
+		// only counters bumped by this record are checked
+		if !record.Alias {
+			usage.Aliases = 0
+		}
+		if !created {
+			usage.Monthly = nil
+		}
+		if exceeded := scope.quotas.Exceeded(usage, month); exceeded != nil {
+			release()
+			for i := range exceeded {
+				exceeded[i].Used-- // without this record
+			}
+			panic(httpErr{
+				code:  http.StatusForbidden,
+				descr: fmt.Sprintf("%s quota exceeded", scope.name),
+				quota: &quotaExceeded{Scope: scope.name, Limits: exceeded}}) //403
+		}
+	}
+	return release
+}
+
+// uncount deleted record
+func releaseUsage(ctx context.Context, record URLData) {
+	if backend_usage == nil || record.Workspace == "" {
+		return
+	}
+	fields := usageFieldsOf(record, "")
+	for _, scope := range usageScopesOf(workspace.Workspace{Name: record.Workspace}, record.Owner) {
+		if err := addUsage(ctx, scope.key, fields, -1); err != nil {
+			slog.ErrorContext(ctx, "couldn't release usage", "key", scope.key, "error", err)
+		}
+	}
+}
+
+func reportOf(usage workspace.Usage, month string, quotas workspace.Quotas) usageReport {
+	return usageReport{
+		Links:        usage.Links,
+		MonthlyLinks: usage.Monthly[month],
+		Aliases:      usage.Aliases,
+		Quotas:       quotas,
+	}
+}
+
+// handle /me/usage requests: usage and quotas of the caller's workspace and user
+func me(w http.ResponseWriter, r *http.Request) {
+	defer recover_hdl(w, r)
+	setCachePolicy(w, r)
+	requireWorkspaces()
+	if backend_usage == nil {
+		panic(httpErr{
+			code:  http.StatusNotImplemented,
+			descr: "quotas are not configured"}) //501
+	}
+	r = authenticate(r)
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	t := tenantOf(r)
+	month := workspace.Month(time.Now())
+	scopes := usageScopesOf(t.workspace, t.key.User)
+	report := meUsage{
+		Workspace:      t.workspace.Name,
+		User:           t.key.User,
+		Month:          month,
+		WorkspaceUsage: reportOf(findUsage(r.Context(), scopes[0].key), month, scopes[0].quotas),
+	}
+	if len(scopes) > 1 {
+		user := reportOf(findUsage(r.Context(), scopes[1].key), month, scopes[1].quotas)
+		report.UserUsage = &user
+	}
+	sendJsonResponse(w, r, http.StatusOK, report)
+}
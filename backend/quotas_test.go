@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"url-shortener/db_interface"
+	"url-shortener/workspace"
+)
+
+// mock usage collection
+
+type usageCollectionMock struct {
+	unsupportedCollection
+	usage []workspace.Usage
+}
+
+func (collection *usageCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(workspace.Usage)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	for _, usage := range collection.usage {
+		if usage.Key == t.Key {
+			return "", db_interface.ErrDuplicateKey
+		}
+	}
+	t.ID = fmt.Sprintf("%d", len(collection.usage))
+	collection.usage = append(collection.usage, t)
+	return t.ID, nil
+}
+
+func (collection *usageCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	f, ok := filter.(workspace.Usage)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	r, ok := result.(*workspace.Usage)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	for _, usage := range collection.usage {
+		if usage.Key == f.Key {
+			*r = usage
+			r.Monthly = maps.Clone(usage.Monthly)
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func (collection *usageCollectionMock) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	f, ok := filter.(workspace.Usage)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	for i := range collection.usage {
+		usage := &collection.usage[i]
+		if usage.Key != f.Key {
+			continue
+		}
+		month, is_monthly := strings.CutPrefix(field, "monthly.")
+		switch {
+		case field == "links":
+			usage.Links += by
+		case field == "aliases":
+			usage.Aliases += by
+		case is_monthly:
+			if usage.Monthly == nil {
+				usage.Monthly = map[string]int{}
+			}
+			usage.Monthly[month] += by
+		default:
+			return fmt.Errorf("unsupported field %s", field)
+		}
+		return nil
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func TestQuotas(t *testing.T) {
+	SetWorkspaces(&workspaceCollectionMock{}, &keyCollectionMock{}, "admin-secret")
+	defer SetWorkspaces(nil, nil, "")
+	SetUsageCollection(&usageCollectionMock{})
+	defer SetUsageCollection(nil)
+	mock_db.data = mock_db.data[:0] //clear data
+	setupMocks()
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-API-Key", token)
+		switch {
+		case strings.HasPrefix(path, "/shorten"):
+			shorten(w, r)
+		case strings.HasPrefix(path, "/me"):
+			me(w, r)
+		default:
+			workspaces(w, r)
+		}
+		return w
+	}
+	w := request("POST", "/workspaces", "admin-secret",
+		`{"name": "acme", "user": "alice", "quotas": {"maxLinks": 3, "monthlyLinks": 4, "maxAliases": 1}, "userQuotas": {"maxLinks": 2}}`)
+	created := newWorkspace{}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("json error %v %s", err, w.Body.String())
+	}
+	alice := created.Key.Token
+	bob_key := newKey{}
+	json.Unmarshal(request("POST", "/workspaces/acme/keys", "admin-secret", `{"user": "bob"}`).Body.Bytes(), &bob_key)
+	bob := bob_key.Token
+	exceeded := func(w *httptest.ResponseRecorder, scope string, quota string) {
+		t.Helper()
+		response := errorResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("json error %v", err)
+		}
+		if w.Code != http.StatusForbidden || response.Quota == nil || response.Quota.Scope != scope ||
+			len(response.Quota.Limits) == 0 || response.Quota.Limits[0].Quota != quota {
+			t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+		}
+	}
+
+	// user quota
+	for _, url := range []string{"http://someurl.com/1", "http://someurl.com/2"} {
+		if w := request("POST", "/shorten", alice, `{"url": "`+url+`"}`); w.Code != http.StatusCreated {
+			t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+		}
+	}
+	w = request("POST", "/shorten", alice, `{"url": "http://someurl.com/3"}`)
+	exceeded(w, "user", "maxLinks")
+	if !strings.Contains(w.Body.String(), `{"quota":"maxLinks","max":2,"used":2}`) {
+		t.Errorf("invalid limits %s", w.Body.String())
+	}
+
+	// custom aliases
+	for body, code := range map[string]int{
+		`{"url": "http://someurl.com/4", "shortCode": "ab"}`:      http.StatusBadRequest,
+		`{"url": "http://someurl.com/4", "shortCode": "a/b/c"}`:   http.StatusBadRequest,
+		`{"url": "http://someurl.com/4", "shortCode": "Shorten"}`: http.StatusBadRequest,
+		`{"url": "http://someurl.com/4", "shortCode": "promo"}`:   http.StatusCreated,
+	} {
+		if w := request("POST", "/shorten", bob, body); w.Code != code {
+			t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+		}
+	}
+	if w := request("POST", "/shorten", alice, `{"url": "http://someurl.com/4", "shortCode": "promo"}`); w.Code != http.StatusConflict {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if record := mock_db.data[2]; record.ShortCode != "promo" || !record.Alias || record.Owner != "bob" {
+		t.Errorf("invalid record %+v", record)
+	}
+	w = httptest.NewRecorder()
+	root(http.NotFoundHandler())(w, httptest.NewRequest("GET", "/promo", nil))
+	if w.Code != http.StatusFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// workspace quotas
+	exceeded(request("POST", "/shorten", bob, `{"url": "http://someurl.com/5"}`), "workspace", "maxLinks")
+	if w := request("DELETE", "/shorten/promo", alice, ""); w.Code != http.StatusNoContent {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	w = request("GET", "/me/usage", bob, "")
+	report := meUsage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("json error %v", err)
+	}
+	if report.Workspace != "acme" || report.User != "bob" || report.WorkspaceUsage.Links != 2 || report.WorkspaceUsage.MonthlyLinks != 3 ||
+		report.WorkspaceUsage.Aliases != 0 || report.WorkspaceUsage.Quotas.MaxLinks != 3 ||
+		report.UserUsage == nil || report.UserUsage.Links != 0 || report.UserUsage.Quotas.MaxLinks != 2 {
+		t.Errorf("invalid usage %s", w.Body.String())
+	}
+	if w := request("POST", "/shorten", bob, `{"url": "http://someurl.com/5", "shortCode": "sale"}`); w.Code != http.StatusCreated {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	// deleting frees links, but not monthly creations
+	request("DELETE", "/shorten/sale", bob, "")
+	exceeded(request("POST", "/shorten", bob, `{"url": "http://someurl.com/6"}`), "workspace", "monthlyLinks")
+	// restoring counts as an active link again
+	if w := request("POST", "/shorten/sale/restore", bob, ""); w.Code != http.StatusOK {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	exceeded(request("POST", "/shorten/promo/restore", bob, ""), "workspace", "maxLinks")
+	if w := request("GET", "/me/usage", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	backend_clicks.Flush(context.Background())
+}
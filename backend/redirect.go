@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"url-shortener/metrics"
+)
+
+var frontendDir = "./frontend"
+
+// suffix of short code requesting a preview, e.g. /abc123+
+const previewSuffix = "+"
+
+// link page template data
+type linkPage struct {
+	URL         string
+	Host        string
+	Title       string
+	Description string
+	ShortURL    string
+	CreatedAt   time.Time
+	ContinueURL string
+	Protected   bool // continuing needs the password again, posted with a form
+}
+
+// helpers
+
+// whether name refers to a file served by the frontend
+func isStaticFile(name string) bool {
+	info, err := os.Stat(filepath.Join(frontendDir, path.Clean("/"+name)))
+	return err == nil && !info.IsDir()
+}
+
+// count click, on variant if any (written to db asynchronously)
+func countClick(domain string, short_code string, variant string) {
+	backend_clicks.AddVariant(domain, short_code, variant)
+	metrics.IncRedirects()
+}
+
+// password page template data
+type passwordPage struct {
+	Action string
+	Error  string
+}
+
+// render preview or interstitial page of record
+func renderLinkPage(w http.ResponseWriter, r *http.Request, name string, record URLData, suffix string) {
+	destination := destinationOf(record, suffix, r.URL.Query())
+	// keep signature and passed through parameters
+	query := r.URL.Query()
+	query.Del("preview")
+	query.Set("continue", "1")
+	continue_path := "/" + url.PathEscape(record.ShortCode)
+	if suffix != "" {
+		continue_path += "/" + suffix
+	}
+	page := linkPage{
+		URL:         destination,
+		Title:       record.Title,
+		Description: record.Description,
+		ShortURL:    publicURL(r, record.Domain, record.ShortCode),
+		CreatedAt:   record.CreatedAt,
+		ContinueURL: continue_path + "?" + query.Encode(),
+		Protected:   record.PasswordHash != "",
+	}
+	if u, err := url.Parse(destination); err == nil {
+		page.Host = u.Host
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderHTML(w, http.StatusOK, name, page)
+}
+
+// redirect to registered url
+// shows preview page for /{code}+ or ?preview=1, warning page for interstitial links
+// protected links require password posted via form or sent in X-Link-Password header
+// suffix is the escaped path after the code, only links passing paths accept it
+func redirect(short_code string, suffix string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	preview := query.Get("preview") == "1"
+	if strings.HasSuffix(short_code, previewSuffix) {
+		short_code = strings.TrimSuffix(short_code, previewSuffix)
+		preview = true
+	}
+	// codes are resolved on the domain of the Host
+	record := findRecord(r, domainOf(r), short_code)
+	if suffix != "" && !record.PassPath {
+		panic(httpErr{
+			code:  http.StatusNotFound,
+			descr: fmt.Sprintf("Not found %s", r.URL.Path)})
+	}
+	if suffix != "" {
+		checkSuffix(r, suffix)
+	}
+	requireSignature(r, record)
+	if len(record.Rules) > 0 {
+		// responses depend on the client
+		w.Header().Add("Vary", "User-Agent, Accept-Language")
+	}
+	// first matching rule wins, clients matched by none are split between variants
+	variant := ""
+	if target, ok := targetOf(r, record); ok {
+		record.URL = target
+	} else if len(record.Variants) > 0 {
+		record.URL, variant = pickVariant(w, r, record)
+	}
+	// submitted password page acts as the warning page
+	unlocked := false
+	if record.PasswordHash != "" {
+		password := r.Header.Get(linkPasswordHeader)
+		if r.Method == "POST" {
+			password = r.PostFormValue("password")
+		}
+		if err := checkLinkPassword(r, record, password); err != nil {
+			page := passwordPage{Action: r.URL.RequestURI()}
+			if password != "" || err.code == http.StatusTooManyRequests {
+				page.Error = err.descr
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			renderHTML(w, err.code, "password.html", page)
+			return
+		}
+		unlocked = r.Method == "POST"
+	}
+	switch {
+	case preview:
+		renderLinkPage(w, r, "preview.html", record, suffix)
+	case record.Interstitial && !unlocked && query.Get("continue") != "1":
+		renderLinkPage(w, r, "interstitial.html", record, suffix)
+	case r.Method == "POST":
+		countClick(record.Domain, short_code, variant)
+		http.Redirect(w, r, destinationOf(record, suffix, query), http.StatusSeeOther) // 303, follow up with GET
+	default:
+		countClick(record.Domain, short_code, variant)
+		http.Redirect(w, r, destinationOf(record, suffix, query), http.StatusFound) // 302, so that clicks keep being counted
+	}
+}
+
+// serve frontend, resolve short codes on /{code}
+func root(static http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer recover_hdl(w, r)
+		// escaped, so that the passed path suffix keeps its encoding
+		tokens := tokenizePath(r.URL.EscapedPath())
+		if tokens[0] != "" && !isStaticFile(r.URL.Path) &&
+			(r.Method == "GET" || r.Method == "HEAD" || r.Method == "POST") {
+			setCachePolicy(w, r)
+			short_code, err := url.PathUnescape(tokens[0])
+			if err != nil {
+				short_code = tokens[0]
+			}
+			redirect(short_code, strings.Join(tokens[1:], "/"), w, r)
+			return
+		}
+		static.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"url-shortener/geoip"
+	"url-shortener/url_data"
+)
+
+const maxRules int = 20
+
+var backend_geoip *geoip.DB
+
+// sets country database used by routing rules. should be called before Start()
+// without it, rules with countries never match
+func SetGeoIP(db *geoip.DB) {
+	backend_geoip = db
+}
+
+// helpers
+
+// client platform from User-Agent
+func platformOf(user_agent string) string {
+	switch {
+	case strings.Contains(user_agent, "iPhone"), strings.Contains(user_agent, "iPad"), strings.Contains(user_agent, "iPod"):
+		return url_data.PlatformIOS
+	case strings.Contains(user_agent, "Android"):
+		return url_data.PlatformAndroid
+	}
+	return url_data.PlatformDesktop
+}
+
+// accepted language tags (lowercase), q=0 excluded
+func languagesOf(accept_language string) []string {
+	var languages []string
+	for _, part := range strings.Split(accept_language, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err != nil || weight <= 0 {
+				continue
+			}
+		}
+		languages = append(languages, tag)
+	}
+	return languages
+}
+
+// whether any accepted language matches any rule language
+// rule "de" matches "de" and "de-AT", rule "de-AT" matches only "de-AT"
+func matchLanguages(accepted []string, languages []string) bool {
+	for _, language := range languages {
+		language = strings.ToLower(language)
+		for _, tag := range accepted {
+			if tag == language || strings.HasPrefix(tag, language+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// country of client, empty if unknown
+func countryOf(r *http.Request) string {
+	if backend_geoip == nil {
+		return ""
+	}
+	return backend_geoip.Country(clientIP(r))
+}
+
+// whether all conditions of rule match the request
+func matchRule(r *http.Request, rule url_data.Rule, now time.Time) bool {
+	if len(rule.Platforms) > 0 && !slices.Contains(rule.Platforms, platformOf(r.UserAgent())) {
+		return false
+	}
+	if len(rule.Languages) > 0 && !matchLanguages(languagesOf(r.Header.Get("Accept-Language")), rule.Languages) {
+		return false
+	}
+	if len(rule.Countries) > 0 && !slices.Contains(rule.Countries, countryOf(r)) {
+		return false
+	}
+	if rule.From != nil && now.Before(*rule.From) {
+		return false
+	}
+	if rule.Until != nil && !now.Before(*rule.Until) {
+		return false
+	}
+	return true
+}
+
+// destination of the first matching rule, false if none matches
+func targetOf(r *http.Request, record URLData) (string, bool) {
+	now := time.Now()
+	for _, rule := range record.Rules {
+		if matchRule(r, rule, now) {
+			return rule.URL, true
+		}
+	}
+	return "", false
+}
+
+// normalize rules, fails with 400 on invalid ones
+func checkRules(record *URLData) {
+	if len(record.Rules) > maxRules {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("too many rules, at most %d allowed", maxRules)}) //400
+	}
+	for i := range record.Rules {
+		rule := &record.Rules[i]
+		invalid := func(descr string) {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("rule %d: %s", i+1, descr)}) //400
+		}
+		if u, err := url.Parse(rule.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("url must be absolute")
+		}
+		for j, platform := range rule.Platforms {
+			platform = strings.ToLower(strings.TrimSpace(platform))
+			switch platform {
+			case url_data.PlatformIOS, url_data.PlatformAndroid, url_data.PlatformDesktop:
+			default:
+				invalid(fmt.Sprintf("invalid platform %q, expected %s, %s or %s", platform,
+					url_data.PlatformIOS, url_data.PlatformAndroid, url_data.PlatformDesktop))
+			}
+			rule.Platforms[j] = platform
+		}
+		for j, language := range rule.Languages {
+			rule.Languages[j] = strings.ToLower(strings.TrimSpace(language))
+			if rule.Languages[j] == "" {
+				invalid("empty language")
+			}
+		}
+		for j, country := range rule.Countries {
+			rule.Countries[j] = strings.ToUpper(strings.TrimSpace(country))
+			if len(rule.Countries[j]) != 2 {
+				invalid(fmt.Sprintf("invalid country %q, expected a 2-letter code", country))
+			}
+		}
+		if rule.From != nil && rule.Until != nil && !rule.From.Before(*rule.Until) {
+			invalid("from must be before until")
+		}
+	}
+	if len(record.Rules) == 0 {
+		record.Rules = nil
+	}
+}
@@ -0,0 +1,40 @@
+package backend
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"url-shortener/url_data"
+)
+
+const searchMaxLen int = 20
+
+// helpers
+
+// host of url, stored for searching
+func hostOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// find links by url, host, title and tags, most relevant first
+func searchRecords(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: "missing search query q"})
+	}
+	slog.DebugContext(r.Context(), "searching records")
+	filter := url_data.ListFilter{Workspace: workspaceOf(r), Deleted: url_data.NotDeleted()}
+	records := make([]URLData, 0, searchMaxLen)
+	handleDBErrors(backend_db.Search(r.Context(), query, filter, searchMaxLen, &records))
+	for i := range records {
+		records[i].Redact()
+	}
+	sendJsonResponse(w, r, http.StatusOK, records)
+}
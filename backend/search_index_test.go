@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// in-process inverted index ranking docs by weighted term frequency
+// mirrors the db text index for the collection mock
+type searchIndex struct {
+	postings map[string]map[string]float64 // term -> doc id -> score
+}
+
+// split text into lowercase words, urls are split on punctuation too
+func tokenizeText(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: map[string]map[string]float64{}}
+}
+
+// index text of doc, every occurrence of a term adds weight to its score
+// may be called several times per doc (e.g. once per field)
+func (index *searchIndex) Add(id string, text string, weight float64) {
+	for _, term := range tokenizeText(text) {
+		docs, ok := index.postings[term]
+		if !ok {
+			docs = map[string]float64{}
+			index.postings[term] = docs
+		}
+		docs[id] += weight
+	}
+}
+
+// ids of docs matching any term of query, most relevant first
+// ties are broken by id to keep results stable
+func (index *searchIndex) Search(query string, limit int) []string {
+	scores := map[string]float64{}
+	for _, term := range tokenizeText(query) {
+		for id, score := range index.postings[term] {
+			scores[id] += score
+		}
+	}
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if limit >= 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	tokens := tokenizeText("https://Shop.example.com/spring-sale?utm=1 Spring")
+	expected := []string{"https", "shop", "example", "com", "spring", "sale", "utm", "1", "spring"}
+	if !slices.Equal(tokens, expected) {
+		t.Errorf("invalid tokens %q", tokens)
+	}
+
+	index := newSearchIndex()
+	index.Add("1", "http://example.com/spring", 1)
+	index.Add("2", "http://shop.com", 1)
+	index.Add("2", "Spring sale", 10)
+	index.Add("3", "http://example.com/autumn", 1)
+
+	if ids := index.Search("spring", 10); !slices.Equal(ids, []string{"2", "1"}) {
+		t.Errorf("invalid ranking %q", ids)
+	}
+	// any term matches, more matching terms rank higher
+	if ids := index.Search("Example autumn", 10); !slices.Equal(ids, []string{"3", "1"}) {
+		t.Errorf("invalid ranking %q", ids)
+	}
+	if ids := index.Search("example", 1); !slices.Equal(ids, []string{"1"}) {
+		t.Errorf("limit wasn't applied %q", ids)
+	}
+	if ids := index.Search("winter", 10); len(ids) != 0 {
+		t.Errorf("unexpected match %q", ids)
+	}
+}
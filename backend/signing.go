@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"url-shortener/url_signer"
+)
+
+const defaultSignedTTL = 24 * time.Hour
+const maxSignedTTL = 365 * 24 * time.Hour
+
+var backend_signer *url_signer.Signer
+
+// sets signer of time-limited links. should be called before Start()
+func SetSigner(signer *url_signer.Signer) {
+	backend_signer = signer
+}
+
+// body of sign request, either field may be set
+type signRequest struct {
+	ExpiresIn string    `json:"expiresIn,omitempty"` // duration, e.g. 1h30m
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// signed link response
+type signedLink struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// helpers
+
+// what signatures of record cover, so they aren't valid for the same code on other domains
+// codes of the default domain are signed as is
+func signedName(record URLData) string {
+	if record.Domain == "" {
+		return record.ShortCode
+	}
+	return record.Domain + "/" + record.ShortCode
+}
+
+// expiry requested by sign request body (may be empty)
+func expiryFromBody(r *http.Request) time.Time {
+	now := time.Now()
+	req := signRequest{}
+	if body := readBody(r); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("Error processing request: %v", err)})
+		}
+	}
+	expires := now.Add(defaultSignedTTL)
+	switch {
+	case req.ExpiresIn != "":
+		ttl, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("invalid expiresIn: %v", err)})
+		}
+		expires = now.Add(ttl)
+	case !req.ExpiresAt.IsZero():
+		expires = req.ExpiresAt
+	}
+	if !expires.After(now) || expires.Sub(now) > maxSignedTTL {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("expiry must be in the future and within %v", maxSignedTTL)})
+	}
+	return expires
+}
+
+// mint signed, time-limited link to short code
+func signLink(short_code string, w http.ResponseWriter, r *http.Request) {
+	if backend_signer == nil {
+		panic(httpErr{
+			code:  http.StatusNotImplemented,
+			descr: "link signing is not configured"})
+	}
+	expires := expiryFromBody(r)
+	// make sure short code exists
+	record := findRecord(r, apiDomainOf(r), short_code)
+
+	query := url.Values{}
+	query.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", backend_signer.Sign(signedName(record), expires))
+	sendJsonResponse(w, r, http.StatusCreated, signedLink{
+		URL:       publicURL(r, record.Domain, short_code) + "?" + query.Encode(),
+		ExpiresAt: time.Unix(expires.Unix(), 0).UTC(),
+	}) // 201
+}
+
+// check exp & sig query parameters of request for record
+// signed-only records can't be resolved without them
+func requireSignature(r *http.Request, record URLData) {
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if sig == "" {
+		if record.SignedOnly {
+			panic(httpErr{
+				code:  http.StatusForbidden,
+				descr: "signed link required"})
+		}
+		return
+	}
+	if backend_signer == nil {
+		panic(httpErr{
+			code:  http.StatusForbidden,
+			descr: "invalid signature"})
+	}
+	switch err := backend_signer.Verify(signedName(record), query.Get("exp"), sig, time.Now()); err {
+	case nil:
+		// valid
+	case url_signer.ErrExpired:
+		panic(httpErr{
+			code:  http.StatusGone,
+			descr: err.Error()})
+	default:
+		panic(httpErr{
+			code:  http.StatusForbidden,
+			descr: err.Error()})
+	}
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+	"url-shortener/audit"
+	"url-shortener/db_interface"
+	"url-shortener/url_data"
+)
+
+const purgeBatchLen int = 1000
+
+// actor of changes made by the server itself
+const systemActor = "system"
+
+var delete_retention = 30 * 24 * time.Hour
+var purge_interval = time.Hour
+var reserve_deleted_codes bool
+var purger_stop chan struct{}
+var purger_done chan struct{}
+
+// sets for how long deleted links can be restored, how often they're purged afterwards,
+// and whether purged codes may be issued again (reservation relies on the audit trail)
+// should be called before Start()
+func SetDeletion(retention time.Duration, interval time.Duration, reserve_codes bool) {
+	delete_retention = retention
+	purge_interval = interval
+	reserve_deleted_codes = reserve_codes
+}
+
+// helpers
+
+// whether short code was ever used (according to the audit trail)
+// on any domain, which errs on the side of reserving
+func codeWasUsed(ctx context.Context, short_code string) bool {
+	if backend_audit == nil {
+		return false
+	}
+	events := make([]audit.Event, 0, 1)
+	handleDBErrors(backend_audit.FindSome(ctx, audit.Event{ShortCode: short_code}, 1, &events))
+	return len(events) > 0
+}
+
+// restore deleted short code within retention window
+func restoreRecord(short_code string, w http.ResponseWriter, r *http.Request) {
+	record := URLData{}
+	filter := url_data.ByCode(apiDomainOf(r), short_code)
+	handleDBErrors(backend_db.FindOne(r.Context(), filter, &record))
+	checkOwner(r, record)
+	if !record.Deleted {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: "link isn't deleted"})
+	}
+	if time.Since(record.DeletedAt) > delete_retention {
+		panic(httpErr{
+			code:  http.StatusGone,
+			descr: "retention period is over, link can't be restored"})
+	}
+	deleted := record
+	record.Deleted = false
+	record.DeletedAt = time.Time{}
+	record.UpdatedAt = time.Now()
+	record.Version++
+	// only deletion fields change, so that clicks flushed meanwhile are kept
+	filter.Version = deleted.Version
+	release := reserveUsage(r, record, false)
+	err := backend_db.UpdateOne(r.Context(), filter, &url_data.RestoreData{UpdatedAt: record.UpdatedAt, Version: record.Version})
+	if err != nil {
+		release()
+	}
+	if err == db_interface.ErrNoDocuments {
+		panic(httpErr{
+			code:  http.StatusConflict,
+			descr: "link was modified concurrently"})
+	}
+	handleDBErrors(err)
+	recordEvent(r.Context(), actorOf(r), short_code, audit.ActionRestore, &deleted, &record)
+	setETag(w, record)
+	record.Redact()
+	sendJsonResponse(w, r, http.StatusOK, record) // 200
+}
+
+// hard-delete records whose retention period is over, batch by batch
+func purgeDeleted(ctx context.Context) {
+	cutoff := time.Now().Add(-delete_retention)
+	filter := url_data.DeletedBefore(cutoff)
+	purged := 0
+	for {
+		records := make([]URLData, 0, purgeBatchLen)
+		if err := backend_db.FindSome(ctx, filter, purgeBatchLen, &records); err != nil {
+			slog.ErrorContext(ctx, "couldn't list deleted records", "error", err)
+			break
+		}
+		batch, failed := 0, 0
+		for i := range records {
+			record := &records[i]
+			// records restored in the meantime are left alone
+			err := backend_db.DeleteOne(ctx, url_data.PurgeOf(record.Domain, record.ShortCode, cutoff))
+			if err == db_interface.ErrNoDocuments {
+				slog.InfoContext(ctx, "record was restored before purge", "code", record.ShortCode)
+				continue
+			} else if err != nil {
+				slog.ErrorContext(ctx, "couldn't purge record", "code", record.ShortCode, "error", err)
+				failed++
+				continue
+			}
+			recordEvent(ctx, systemActor, record.ShortCode, audit.ActionPurge, record, nil)
+			batch++
+		}
+		purged += batch
+		// failed records would come back in the next batch
+		if len(records) < purgeBatchLen || failed > 0 {
+			break
+		}
+	}
+	if purged > 0 {
+		slog.InfoContext(ctx, "purged deleted records", "count", purged)
+	}
+}
+
+// run purges in background
+func startPurger() {
+	if purge_interval <= 0 {
+		return
+	}
+	purger_stop = make(chan struct{})
+	purger_done = make(chan struct{})
+	go func() {
+		defer close(purger_done)
+		ticker := time.NewTicker(purge_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				purgeDeleted(context.Background())
+			case <-purger_stop:
+				return
+			}
+		}
+	}()
+}
+
+// stop background purges
+func stopPurger() {
+	if purger_stop != nil {
+		close(purger_stop)
+		<-purger_done
+		purger_stop = nil
+	}
+}
@@ -0,0 +1,29 @@
+package backend
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+//go:embed templates/*.html
+var template_fs embed.FS
+
+// server-side rendered pages
+var templates = template.Must(template.ParseFS(template_fs, "templates/*.html"))
+
+// render html template, name is the template file name
+func renderHTML(w http.ResponseWriter, status int, name string, data any) {
+	// render into buffer first, so that errors don't produce half a page
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		panic(httpErr{
+			code:  http.StatusInternalServerError,
+			descr: fmt.Sprintf("error rendering page: %v", err)})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
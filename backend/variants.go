@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+	"url-shortener/url_data"
+)
+
+const maxVariants int = 10
+const maxVariantWeight int = 10000
+
+// how long sticky variants are remembered
+const variantCookieAge = 30 * 24 * time.Hour
+
+// variant names end up in db field names and cookies
+var variantNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// helpers
+
+// name of the cookie remembering the variant of short code
+func variantCookie(short_code string) string {
+	return "v_" + url.QueryEscape(short_code)
+}
+
+// variant at position n of the cumulated weights, 0 <= n < sum of weights
+func variantAt(variants []url_data.Variant, n int) url_data.Variant {
+	for _, variant := range variants {
+		if n < variant.Weight {
+			return variant
+		}
+		n -= variant.Weight
+	}
+	return variants[len(variants)-1]
+}
+
+// pick variant of record at random according to weights
+// sticky variants are reused from and stored in a cookie
+// returns destination and variant name
+func pickVariant(w http.ResponseWriter, r *http.Request, record URLData) (string, string) {
+	cookie_name := variantCookie(record.ShortCode)
+	if record.StickyVariants {
+		w.Header().Add("Vary", "Cookie")
+		if cookie, err := r.Cookie(cookie_name); err == nil {
+			for _, variant := range record.Variants {
+				if variant.Name == cookie.Value {
+					return variant.URL, variant.Name
+				}
+			}
+		}
+	}
+	total := 0
+	for _, variant := range record.Variants {
+		total += variant.Weight
+	}
+	variant := variantAt(record.Variants, rand.IntN(total))
+	if record.StickyVariants {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookie_name,
+			Value:    variant.Name,
+			Path:     "/" + url.PathEscape(record.ShortCode),
+			MaxAge:   int(variantCookieAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return variant.URL, variant.Name
+}
+
+// complete variant names and weights, fails with 400 on invalid ones
+func checkVariants(record *URLData) {
+	if len(record.Variants) > maxVariants {
+		panic(httpErr{
+			code:  http.StatusBadRequest,
+			descr: fmt.Sprintf("too many variants, at most %d allowed", maxVariants)}) //400
+	}
+	seen := map[string]bool{}
+	for i := range record.Variants {
+		variant := &record.Variants[i]
+		if variant.Name == "" {
+			variant.Name = string(rune('a' + i))
+		}
+		invalid := func(descr string) {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: fmt.Sprintf("variant %s: %s", variant.Name, descr)}) //400
+		}
+		if !variantNameRe.MatchString(variant.Name) {
+			invalid("name must be 1-32 letters, digits, _ or -")
+		}
+		if seen[variant.Name] {
+			invalid("duplicate name")
+		}
+		seen[variant.Name] = true
+		if u, err := url.Parse(variant.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("url must be absolute")
+		}
+		if variant.Weight == 0 {
+			variant.Weight = 1
+		}
+		if variant.Weight < 0 || variant.Weight > maxVariantWeight {
+			invalid(fmt.Sprintf("weight must be between 1 and %d", maxVariantWeight))
+		}
+	}
+	if len(record.Variants) == 0 {
+		record.Variants = nil
+		record.StickyVariants = false
+	}
+}
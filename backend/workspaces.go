@@ -0,0 +1,296 @@
+package backend
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/workspace"
+)
+
+const keyListMaxLen int = 100
+
+var backend_workspaces DB
+var backend_keys DB
+var admin_token string
+
+// sets collections of workspaces and their api keys, which turns multi-tenancy on:
+// api requests need a key then and only see links of its workspace
+// admin token allows creating workspaces. should be called before Start()
+func SetWorkspaces(workspaces DB, keys DB, token string) {
+	backend_workspaces = workspaces
+	backend_keys = keys
+	admin_token = token
+}
+
+// authenticated caller, signed in with an api key or a session
+type tenant struct {
+	workspace workspace.Workspace
+	key       workspace.APIKey // only workspace and user are set for sessions
+}
+
+type tenantKey struct{}
+
+// workspace creation request, the response carries the first api key
+type workspaceRequest struct {
+	workspace.Workspace
+	User string `json:"user"` // owner of the first key
+}
+
+// newly created api key, the token is only shown once
+type newKey struct {
+	workspace.APIKey
+	Token string `json:"token"`
+}
+
+type newWorkspace struct {
+	Workspace workspace.Workspace `json:"workspace"`
+	Key       newKey              `json:"key"`
+}
+
+// helpers
+
+// bearer token or X-API-Key of request
+func tokenOf(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// attach caller to request, fails with 401 without valid api key or session
+// (and with 403 on changes without the csrf token of the session)
+// requests pass as they are while multi-tenancy is off
+func authenticate(r *http.Request) *http.Request {
+	if backend_workspaces == nil {
+		return r
+	}
+	t := tenant{}
+	token := tokenOf(r)
+	if token != "" {
+		err := backend_keys.FindOne(r.Context(), workspace.APIKey{Hash: workspace.HashToken(token)}, &t.key)
+		if err == db_interface.ErrNoDocuments {
+			panic(httpErr{
+				code:  http.StatusUnauthorized,
+				descr: "invalid api key"}) //401
+		}
+		handleDBErrors(err)
+	} else if session := findSession(r); session != nil {
+		checkCSRF(r, *session)
+		t.key = workspace.APIKey{Workspace: session.Workspace, User: session.User}
+	} else {
+		panic(httpErr{
+			code:  http.StatusUnauthorized,
+			descr: "api key or session required"}) //401
+	}
+	// keys and sessions of deleted workspaces are no longer valid
+	err := backend_workspaces.FindOne(r.Context(), workspace.Workspace{Name: t.key.Workspace}, &t.workspace)
+	if err == db_interface.ErrNoDocuments {
+		panic(httpErr{
+			code:  http.StatusUnauthorized,
+			descr: "workspace no longer exists"}) //401
+	}
+	handleDBErrors(err)
+	return r.WithContext(context.WithValue(r.Context(), tenantKey{}, &t))
+}
+
+// fails with 403 unless request carries the admin token
+func requireAdmin(r *http.Request) {
+	token := tokenOf(r)
+	if admin_token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(admin_token)) != 1 {
+		panic(httpErr{
+			code:  http.StatusForbidden,
+			descr: "admin token required"}) //403
+	}
+}
+
+// caller of request, nil while multi-tenancy is off
+func tenantOf(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// workspace of the caller, empty while multi-tenancy is off
+func workspaceOf(r *http.Request) string {
+	if t := tenantOf(r); t != nil {
+		return t.workspace.Name
+	}
+	return ""
+}
+
+func requireWorkspaces() {
+	if backend_workspaces == nil {
+		panic(httpErr{
+			code:  http.StatusNotImplemented,
+			descr: "workspaces are not configured"}) //501
+	}
+}
+
+// links of other workspaces don't exist for the caller
+func checkOwner(r *http.Request, record URLData) {
+	if ws := workspaceOf(r); ws != "" && record.Workspace != ws {
+		panic(httpErr{
+			code:  http.StatusNotFound,
+			descr: db_interface.ErrNoDocuments.Error()}) //404
+	}
+}
+
+// custom domains are reserved to their workspace
+func checkDomainOwner(r *http.Request, domain string) {
+	ws := workspaceOf(r)
+	if ws == "" || domain == "" {
+		return
+	}
+	owner := workspace.Workspace{}
+	err := backend_workspaces.FindOne(r.Context(), workspace.Workspace{Domain: domain}, &owner)
+	if err == nil && owner.Name != ws {
+		panic(httpErr{
+			code:  http.StatusForbidden,
+			descr: fmt.Sprintf("domain %q belongs to another workspace", domain)}) //403
+	} else if err != nil && err != db_interface.ErrNoDocuments {
+		handleDBErrors(err)
+	}
+}
+
+// user and name of the api key to create, both optional
+func keyRequestOf(r *http.Request) workspace.APIKey {
+	req := workspace.APIKey{}
+	if body := readBody(r); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			panic(httpErr{code: http.StatusBadRequest, descr: fmt.Sprintf("Error processing request: %v", err)}) //400
+		}
+	}
+	return req
+}
+
+// create api key of user in the workspace
+func createKey(r *http.Request, ws string, user string, name string) newKey {
+	key, token, err := workspace.NewKey(ws, user, name)
+	if err != nil {
+		panic(fmt.Sprintf("Error creating api key:\n%v", err))
+	}
+	key.ID, err = backend_keys.InsertOne(r.Context(), key)
+	handleDBErrors(err)
+	slog.InfoContext(r.Context(), "api key created", "workspace", ws, "user", user, "hint", key.Hint)
+	return newKey{APIKey: key, Token: token}
+}
+
+// api key ids are ObjectIDs, anything else can't exist
+func checkKeyID(id string) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 24 {
+		panic(httpErr{
+			code:  http.StatusNotFound,
+			descr: db_interface.ErrNoDocuments.Error()}) //404
+	}
+}
+
+// create workspace along with its first api key, admin only
+func createWorkspace(w http.ResponseWriter, r *http.Request) {
+	requireAdmin(r)
+	req := workspaceRequest{}
+	if err := json.Unmarshal(readBody(r), &req); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: fmt.Sprintf("Error processing request: %v", err)}) //400
+	}
+	ws := req.Workspace
+	if err := ws.Normalize(); err != nil {
+		panic(httpErr{code: http.StatusBadRequest, descr: err.Error()}) //400
+	}
+	if ws.Domain != "" {
+		// default domain is shared by everyone
+		if checkDomain(ws.Domain) == "" {
+			panic(httpErr{
+				code:  http.StatusBadRequest,
+				descr: "the default domain can't be reserved"}) //400
+		}
+		err := backend_workspaces.FindOne(r.Context(), workspace.Workspace{Domain: ws.Domain}, &workspace.Workspace{})
+		if err == nil {
+			panic(httpErr{
+				code:  http.StatusConflict,
+				descr: fmt.Sprintf("domain %q belongs to another workspace", ws.Domain)}) //409
+		} else if err != db_interface.ErrNoDocuments {
+			handleDBErrors(err)
+		}
+	}
+	ws.ID = ""
+	ws.CreatedAt = time.Now().UTC()
+	// unique index catches duplicate names
+	var err error
+	ws.ID, err = backend_workspaces.InsertOne(r.Context(), ws)
+	handleDBErrors(err)
+	slog.InfoContext(r.Context(), "workspace created", "workspace", ws.Name)
+	sendJsonResponse(w, r, http.StatusCreated, newWorkspace{
+		Workspace: ws,
+		Key:       createKey(r, ws.Name, req.User, "default"),
+	}) //201
+}
+
+// create api key or account of any user in the workspace, admin only
+func createMember(w http.ResponseWriter, r *http.Request, ws string, kind string) {
+	requireAdmin(r)
+	handleDBErrors(backend_workspaces.FindOne(r.Context(), workspace.Workspace{Name: ws}, &workspace.Workspace{}))
+	if kind == "users" {
+		requireAccounts()
+		user, password := credentialsOf(r)
+		user.Workspace = ws
+		sendJsonResponse(w, r, http.StatusCreated, createUser(r, user, password)) //201
+		return
+	}
+	req := keyRequestOf(r)
+	sendJsonResponse(w, r, http.StatusCreated, createKey(r, ws, req.User, req.Name)) //201
+}
+
+// handle /workspaces (admin) and /workspace (caller's workspace) requests
+func workspaces(w http.ResponseWriter, r *http.Request) {
+	defer recover_hdl(w, r)
+	setCachePolicy(w, r)
+	requireWorkspaces()
+	tokens := tokenizePath(r.URL.Path)
+	if tokens[0] == "workspaces" {
+		member := len(tokens) == 3 && (tokens[2] == "keys" || tokens[2] == "users")
+		switch {
+		case len(tokens) == 1 && r.Method == "POST":
+			createWorkspace(w, r)
+		case member && r.Method == "POST":
+			createMember(w, r, tokens[1], tokens[2])
+		case len(tokens) == 1 || member:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+		}
+		return
+	}
+	r = authenticate(r)
+	t := tenantOf(r)
+	switch {
+	case len(tokens) == 1 && r.Method == "GET":
+		sendJsonResponse(w, r, http.StatusOK, t.workspace)
+	case len(tokens) == 2 && tokens[1] == "keys" && r.Method == "GET":
+		keys := make([]workspace.APIKey, 0, keyListMaxLen)
+		handleDBErrors(backend_keys.FindSome(r.Context(), workspace.APIKey{Workspace: t.workspace.Name}, keyListMaxLen, &keys))
+		sendJsonResponse(w, r, http.StatusOK, keys)
+	case len(tokens) == 2 && tokens[1] == "keys" && r.Method == "POST":
+		req := keyRequestOf(r)
+		// keys are issued to the caller, keys of others need the admin token
+		if req.User != "" && req.User != t.key.User {
+			panic(httpErr{
+				code:  http.StatusForbidden,
+				descr: fmt.Sprintf("keys of other users are created on /workspaces/%s/keys with the admin token", t.workspace.Name)}) //403
+		}
+		sendJsonResponse(w, r, http.StatusCreated, createKey(r, t.workspace.Name, t.key.User, req.Name)) //201
+	case len(tokens) == 3 && tokens[1] == "keys" && r.Method == "DELETE":
+		checkKeyID(tokens[2])
+		handleDBErrors(backend_keys.DeleteOne(r.Context(), workspace.APIKey{ID: tokens[2], Workspace: t.workspace.Name}))
+		slog.InfoContext(r.Context(), "api key revoked", "workspace", t.workspace.Name, "id", tokens[2])
+		w.WriteHeader(http.StatusNoContent) //204
+	case len(tokens) <= 3 && (len(tokens) == 1 || tokens[1] == "keys"):
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		httpError(w, r, fmt.Sprintf("Not found %s", r.URL.Path), http.StatusNotFound) //404
+	}
+}
@@ -0,0 +1,304 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"url-shortener/db_interface"
+	"url-shortener/workspace"
+)
+
+// mock workspace collection
+
+type workspaceCollectionMock struct {
+	unsupportedCollection
+	workspaces []workspace.Workspace
+}
+
+func (collection *workspaceCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(workspace.Workspace)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	for _, ws := range collection.workspaces {
+		if ws.Name == t.Name {
+			return "", db_interface.ErrDuplicateKey
+		}
+	}
+	t.ID = fmt.Sprintf("%d", len(collection.workspaces))
+	collection.workspaces = append(collection.workspaces, t)
+	return t.ID, nil
+}
+
+func (collection *workspaceCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	f, ok := filter.(workspace.Workspace)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	r, ok := result.(*workspace.Workspace)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	for _, ws := range collection.workspaces {
+		if (f.Name == "" || f.Name == ws.Name) && (f.Domain == "" || f.Domain == ws.Domain) {
+			*r = ws
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func (collection *workspaceCollectionMock) DeleteOne(ctx context.Context, filter any) error {
+	f, ok := filter.(workspace.Workspace)
+	if !ok {
+		return fmt.Errorf("invalid filter type %T", filter)
+	}
+	for i, ws := range collection.workspaces {
+		if ws.Name == f.Name {
+			collection.workspaces = slices.Delete(collection.workspaces, i, i+1)
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+// mock api key collection
+
+type keyCollectionMock struct {
+	unsupportedCollection
+	keys   []workspace.APIKey
+	id_cnt int
+}
+
+func (collection *keyCollectionMock) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	t, ok := doc.(workspace.APIKey)
+	if !ok {
+		return "", fmt.Errorf("invalid doc type %T", doc)
+	}
+	t.ID = fmt.Sprintf("%024x", collection.id_cnt)
+	collection.keys = append(collection.keys, t)
+	collection.id_cnt++
+	return t.ID, nil
+}
+
+func (collection *keyCollectionMock) FindOne(ctx context.Context, filter any, result any) error {
+	matches, err := collection.matches(filter)
+	if err != nil {
+		return err
+	}
+	r, ok := result.(*workspace.APIKey)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	for _, key := range collection.keys {
+		if matches(key) {
+			*r = key
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func (collection *keyCollectionMock) DeleteOne(ctx context.Context, filter any) error {
+	matches, err := collection.matches(filter)
+	if err != nil {
+		return err
+	}
+	for i, key := range collection.keys {
+		if matches(key) {
+			collection.keys = slices.Delete(collection.keys, i, i+1)
+			return nil
+		}
+	}
+	return db_interface.ErrNoDocuments
+}
+
+func (collection *keyCollectionMock) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	matches, err := collection.matches(filter)
+	if err != nil {
+		return err
+	}
+	r, ok := result.(*[]workspace.APIKey)
+	if !ok {
+		return fmt.Errorf("invalid result type %T", result)
+	}
+	*r = (*r)[:0]
+	for _, key := range collection.keys {
+		if len(*r) < limit && matches(key) {
+			*r = append(*r, key)
+		}
+	}
+	return nil
+}
+
+func (collection *keyCollectionMock) matches(filter any) (func(key workspace.APIKey) bool, error) {
+	f, ok := filter.(workspace.APIKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid filter type %T", filter)
+	}
+	return func(key workspace.APIKey) bool {
+		return (f.ID == "" || f.ID == key.ID) && (f.Hash == "" || f.Hash == key.Hash) &&
+			(f.Workspace == "" || f.Workspace == key.Workspace)
+	}, nil
+}
+
+func TestWorkspaces(t *testing.T) {
+	workspaces_mock := &workspaceCollectionMock{}
+	SetWorkspaces(workspaces_mock, &keyCollectionMock{}, "admin-secret")
+	defer SetWorkspaces(nil, nil, "")
+	SetDomains([]string{"go.acme.io", "acme.link"})
+	defer SetDomains(nil)
+	mock_db.data = mock_db.data[:0] //clear data
+	setupMocks()
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if strings.HasPrefix(path, "/shorten") {
+			shorten(w, r)
+		} else {
+			workspaces(w, r)
+		}
+		return w
+	}
+	create := func(body string) string {
+		w := request("POST", "/workspaces", "admin-secret", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("invalid response %v %s", w.Code, w.Body.String())
+		}
+		created := newWorkspace{}
+		if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+			t.Fatalf("json error %v", err)
+		}
+		return created.Key.Token
+	}
+
+	// only the admin creates workspaces
+	if w := request("POST", "/workspaces", "", `{"name": "acme"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	acme := create(`{"name": "acme", "domain": "Acme.link", "user": "alice"}`)
+	beta := create(`{"name": "beta", "user": "bob"}`)
+	for body, code := range map[string]int{
+		`{"name": "acme"}`:                          http.StatusConflict,
+		`{"name": "gamma", "domain": "acme.link"}`:  http.StatusConflict,
+		`{"name": "gamma", "domain": "go.acme.io"}`: http.StatusBadRequest,
+		`{"name": "Gamma"}`:                         http.StatusBadRequest,
+	} {
+		if w := request("POST", "/workspaces", "admin-secret", body); w.Code != code {
+			t.Errorf("invalid response code %v for %s", w.Code, body)
+		}
+	}
+
+	// api requests need a valid key
+	if w := request("POST", "/shorten", "", `{"url": "http://someurl.com"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("GET", "/shorten/list", "usk_invalid", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+
+	// links belong to the workspace of the key, on its custom domain by default
+	if w := request("POST", "/shorten", acme, `{"url": "http://someurl.com", "title": "launch"}`); w.Code != http.StatusCreated {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if w := request("POST", "/shorten", beta, `{"url": "http://someurl.com", "title": "launch", "domain": "acme.link"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// same url in another workspace is another link
+	if w := request("POST", "/shorten", beta, `{"url": "http://someurl.com", "title": "launch"}`); w.Code != http.StatusCreated {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if len(mock_db.data) != 2 || mock_db.data[0].Workspace != "acme" || mock_db.data[0].Domain != "acme.link" ||
+		mock_db.data[1].Workspace != "beta" || mock_db.data[1].Domain != "" {
+		t.Fatalf("invalid records %+v", mock_db.data)
+	}
+	acme_code, beta_code := mock_db.data[0].ShortCode, mock_db.data[1].ShortCode
+
+	// listing, search and stats are isolated
+	for _, path := range []string{"/shorten/list", "/shorten/search?q=launch"} {
+		w := request("GET", path, beta, "")
+		list := []URLData{}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Errorf("json error %v", err)
+		}
+		if len(list) != 1 || list[0].ShortCode != beta_code {
+			t.Errorf("invalid list for %s: %+v", path, list)
+		}
+	}
+	if w := request("GET", "/shorten/"+acme_code+"/stats?domain=acme.link", beta, ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("DELETE", "/shorten/"+acme_code+"?domain=acme.link", beta, ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("GET", "/shorten/"+acme_code+"/stats", acme, ""); w.Code != http.StatusOK {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	// redirects stay public
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/"+acme_code, nil)
+	r.Host = "acme.link"
+	root(http.NotFoundHandler())(w, r)
+	if w.Code != http.StatusFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// custom domains which were removed from the configuration fall back to the default one
+	SetDomains([]string{"go.acme.io"})
+	w = request("POST", "/shorten", acme, `{"url": "http://someurl.com/moved"}`)
+	SetDomains([]string{"go.acme.io", "acme.link"})
+	if w.Code != http.StatusCreated || len(mock_db.data) != 3 || mock_db.data[2].Domain != "" {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+
+	// keys of the workspace
+	if w := request("GET", "/workspace", acme, ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"acme"`) {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	w = request("POST", "/workspace/keys", acme, `{"name": "ci"}`)
+	key := newKey{}
+	if err := json.Unmarshal(w.Body.Bytes(), &key); w.Code != http.StatusCreated || err != nil || key.User != "alice" {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	// keys of other users need the admin token
+	if w := request("POST", "/workspace/keys", acme, `{"user": "bob"}`); w.Code != http.StatusForbidden {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	for token, code := range map[string]int{acme: http.StatusForbidden, "admin-secret": http.StatusCreated} {
+		if w := request("POST", "/workspaces/acme/keys", token, `{"user": "bob"}`); w.Code != code || (code == http.StatusCreated && !strings.Contains(w.Body.String(), `"user":"bob"`)) {
+			t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+		}
+	}
+	if w := request("POST", "/workspaces/gamma/keys", "admin-secret", `{"user": "bob"}`); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	w = request("GET", "/workspace/keys", key.Token, "")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"hint"`) != 3 || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("invalid response %v %s", w.Code, w.Body.String())
+	}
+	if w := request("DELETE", "/workspace/keys/not-an-id", acme, ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("DELETE", "/workspace/keys/"+key.ID, beta, ""); w.Code != http.StatusNotFound {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("DELETE", "/workspace/keys/"+key.ID, acme, ""); w.Code != http.StatusNoContent {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	if w := request("GET", "/workspace", key.Token, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	// keys of deleted workspaces are invalid
+	workspaces_mock.DeleteOne(context.Background(), workspace.Workspace{Name: "beta"})
+	if w := request("GET", "/shorten/list", beta, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("invalid response code %v", w.Code)
+	}
+	backend_clicks.Flush(context.Background())
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/url_data"
+)
+
+type URLData = url_data.URLData
+
+// counting collection stub holding a single record
+type collectionStub struct {
+	record *URLData
+	finds  int
+}
+
+func (c *collectionStub) InsertOne(ctx context.Context, doc any) (string, error) {
+	record := doc.(URLData)
+	c.record = &record
+	return "1", nil
+}
+
+func (c *collectionStub) FindOne(ctx context.Context, filter any, result any) error {
+	c.finds++
+	f, ok := filter.(url_data.CodeFilter)
+	if c.record == nil || !ok || f.ShortCode != c.record.ShortCode || f.DomainName() != c.record.Domain {
+		return db_interface.ErrNoDocuments
+	}
+	*result.(*URLData) = *c.record
+	return nil
+}
+
+func (c *collectionStub) UpdateOne(ctx context.Context, filter any, update_with any) error {
+	c.record.URL = update_with.(*URLData).URL
+	return nil
+}
+
+func (c *collectionStub) ReplaceOne(ctx context.Context, filter any, replacement any) error {
+	record := replacement.(URLData)
+	c.record = &record
+	return nil
+}
+
+func (c *collectionStub) DeleteOne(ctx context.Context, filter any) error {
+	c.record = nil
+	return nil
+}
+
+func (c *collectionStub) FindSome(ctx context.Context, filter any, limit int, results any) error {
+	return nil
+}
+
+func (c *collectionStub) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, results any) error {
+	return nil
+}
+
+func (c *collectionStub) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	c.record.AccessCount += by
+	return nil
+}
+
+func (c *collectionStub) Search(ctx context.Context, query string, filter any, limit int, results any) error {
+	return nil
+}
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	lru := NewLRU(2)
+	lru.Set(ctx, "a", []byte("1"), time.Minute)
+	lru.Set(ctx, "b", []byte("2"), time.Minute)
+	lru.Get(ctx, "a") // a becomes most recently used
+	lru.Set(ctx, "c", []byte("3"), time.Minute)
+	if _, err := lru.Get(ctx, "b"); err != ErrMiss {
+		t.Error("least recently used entry should be evicted")
+	}
+	if v, err := lru.Get(ctx, "a"); err != nil || string(v) != "1" {
+		t.Errorf("invalid entry %s %v", v, err)
+	}
+	lru.Set(ctx, "d", []byte("4"), -time.Second)
+	if _, err := lru.Get(ctx, "d"); err != ErrMiss {
+		t.Error("expired entry should miss")
+	}
+	lru.Delete(ctx, "a")
+	if _, err := lru.Get(ctx, "a"); err != ErrMiss {
+		t.Error("deleted entry should miss")
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	stub := &collectionStub{}
+	db := WrapDB(stub, NewLRU(10), time.Minute, time.Minute)
+	filter := url_data.ByCode("", "abc123")
+
+	// negative caching
+	for i := 0; i < 2; i++ {
+		if err := db.FindOne(ctx, filter, &URLData{}); err != db_interface.ErrNoDocuments {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if stub.finds != 1 {
+		t.Errorf("unknown code should be cached, db hit %d times", stub.finds)
+	}
+	// insertion drops negative entry
+	db.InsertOne(ctx, URLData{URL: "http://someurl", ShortCode: "abc123"})
+	result := URLData{}
+	for i := 0; i < 2; i++ {
+		if err := db.FindOne(ctx, filter, &result); err != nil || result.URL != "http://someurl" {
+			t.Errorf("invalid result %v %v", result, err)
+		}
+	}
+	if stub.finds != 2 {
+		t.Errorf("record should be cached, db hit %d times", stub.finds)
+	}
+	// counters are updated in place
+	db.IncrementOne(ctx, filter, "accessCount", 2)
+	db.IncrementOne(ctx, filter, "variantClicks.b", 1)
+	if db.FindOne(ctx, filter, &result); result.AccessCount != 2 || result.VariantClicks["b"] != 1 || stub.finds != 2 {
+		t.Errorf("invalid result %v, db hit %d times", result, stub.finds)
+	}
+	// update invalidates
+	db.UpdateOne(ctx, filter, &URLData{URL: "http://someotherurl"})
+	if db.FindOne(ctx, filter, &result); result.URL != "http://someotherurl" {
+		t.Errorf("stale result %v", result)
+	}
+	// delete invalidates
+	db.DeleteOne(ctx, filter)
+	if err := db.FindOne(ctx, filter, &result); err != db_interface.ErrNoDocuments {
+		t.Errorf("deleted record returned %v", result)
+	}
+	// codes are cached per domain
+	db.InsertOne(ctx, URLData{URL: "http://someurl", ShortCode: "abc123", Domain: "acme.link"})
+	if err := db.FindOne(ctx, url_data.ByCode("acme.link", "abc123"), &result); err != nil || result.Domain != "acme.link" {
+		t.Errorf("invalid result %v %v", result, err)
+	}
+	if err := db.FindOne(ctx, filter, &result); err != db_interface.ErrNoDocuments {
+		t.Errorf("code of other domain returned %v", result)
+	}
+	// non code lookups bypass cache
+	finds := stub.finds
+	db.FindOne(ctx, URLData{URL: "http://someurl"}, &result)
+	db.FindOne(ctx, URLData{URL: "http://someurl"}, &result)
+	if stub.finds != finds+2 {
+		t.Error("url lookups shouldn't be cached")
+	}
+}
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/url_data"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// IDBCollection decorator caching short code lookups (read-through)
+// unknown codes are cached as empty values for negative_ttl
+type dbCollection struct {
+	next         db_interface.IDBCollection
+	cache        ICache
+	ttl          time.Duration
+	negative_ttl time.Duration
+}
+
+// wrap collection with cache
+func WrapDB(collection db_interface.IDBCollection, cache ICache, ttl time.Duration, negative_ttl time.Duration) db_interface.IDBCollection {
+	return &dbCollection{
+		next:         collection,
+		cache:        cache,
+		ttl:          ttl,
+		negative_ttl: negative_ttl,
+	}
+}
+
+// helpers
+
+// cache key of the short code a filter (or doc) refers to, empty if none
+func keyOf(doc any) string {
+	switch d := doc.(type) {
+	case url_data.URLData:
+		return key(d.Domain, d.ShortCode)
+	case *url_data.URLData:
+		return key(d.Domain, d.ShortCode)
+	case url_data.CodeFilter:
+		return key(d.DomainName(), d.ShortCode)
+	}
+	return ""
+}
+
+// cache key for filters looking up a single record by short code only
+func lookupKey(filter any) (string, bool) {
+	f, ok := filter.(url_data.CodeFilter)
+	if !ok || f.ShortCode == "" || f.Version != 0 {
+		return "", false
+	}
+	return key(f.DomainName(), f.ShortCode), true
+}
+
+// codes of the default domain keep their key from before domains were introduced
+func key(domain string, short_code string) string {
+	if short_code == "" {
+		return ""
+	}
+	if domain == "" {
+		return "url:" + short_code
+	}
+	return "url:" + domain + "/" + short_code
+}
+
+func (collection *dbCollection) invalidate(ctx context.Context, docs ...any) {
+	for _, doc := range docs {
+		if key := keyOf(doc); key != "" {
+			if err := collection.cache.Delete(ctx, key); err != nil {
+				slog.WarnContext(ctx, "cache invalidation failed", "key", key, "error", err)
+			}
+		}
+	}
+}
+
+// apply counter increment to the cached record, counters change on every click
+// so they're updated in place rather than dropping the entry. other fields invalidate
+func (collection *dbCollection) increment(ctx context.Context, filter any, field string, by int) {
+	key := keyOf(filter)
+	if key == "" {
+		return
+	}
+	value, err := collection.cache.Get(ctx, key)
+	if err == ErrMiss || (err == nil && len(value) == 0) {
+		return
+	}
+	cached := url_data.URLData{}
+	if err == nil {
+		err = bson.Unmarshal(value, &cached)
+	}
+	variant, is_variant := strings.CutPrefix(field, "variantClicks.")
+	switch {
+	case err != nil:
+	case field == "accessCount":
+		cached.AccessCount += by
+	case is_variant:
+		if cached.VariantClicks == nil {
+			cached.VariantClicks = make(map[string]int)
+		}
+		cached.VariantClicks[variant] += by
+	default:
+		err = fmt.Errorf("unknown counter %s", field)
+	}
+	if err == nil {
+		value, err = bson.Marshal(cached)
+	}
+	if err != nil {
+		collection.invalidate(ctx, filter)
+		return
+	}
+	// increments of several instances sharing the cache may race, counts are then off until the entry is refreshed
+	collection.store(ctx, key, value, collection.ttl)
+}
+
+func (collection *dbCollection) store(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if err := collection.cache.Set(ctx, key, value, ttl); err != nil {
+		slog.WarnContext(ctx, "cache write failed", "key", key, "error", err)
+	}
+}
+
+// dbCollection methods
+
+func (collection *dbCollection) InsertOne(ctx context.Context, doc any) (string, error) {
+	id, err := collection.next.InsertOne(ctx, doc)
+	// drop negative entry of the new code
+	collection.invalidate(ctx, doc)
+	return id, err
+}
+
+func (collection *dbCollection) FindOne(ctx context.Context, filter any, result any) error {
+	key, cacheable := lookupKey(filter)
+	record, is_record := result.(*url_data.URLData)
+	if !cacheable || !is_record {
+		return collection.next.FindOne(ctx, filter, result)
+	}
+	value, err := collection.cache.Get(ctx, key)
+	switch {
+	case err == nil && len(value) == 0:
+		return db_interface.ErrNoDocuments
+	case err == nil:
+		cached := url_data.URLData{}
+		if err := bson.Unmarshal(value, &cached); err == nil {
+			*record = cached
+			return nil
+		}
+		slog.WarnContext(ctx, "dropping corrupt cache entry", "key", key)
+	case err != ErrMiss:
+		slog.WarnContext(ctx, "cache read failed", "key", key, "error", err)
+	}
+
+	err = collection.next.FindOne(ctx, filter, result)
+	switch err {
+	case nil:
+		if value, err := bson.Marshal(record); err == nil {
+			collection.store(ctx, key, value, collection.ttl)
+		}
+	case db_interface.ErrNoDocuments:
+		if collection.negative_ttl > 0 {
+			collection.store(ctx, key, []byte{}, collection.negative_ttl)
+		}
+	}
+	return err
+}
+
+func (collection *dbCollection) UpdateOne(ctx context.Context, filter any, update_with any) error {
+	err := collection.next.UpdateOne(ctx, filter, update_with)
+	// update_with may carry a new short code
+	collection.invalidate(ctx, filter, update_with)
+	return err
+}
+
+func (collection *dbCollection) ReplaceOne(ctx context.Context, filter any, replacement any) error {
+	err := collection.next.ReplaceOne(ctx, filter, replacement)
+	collection.invalidate(ctx, filter, replacement)
+	return err
+}
+
+func (collection *dbCollection) DeleteOne(ctx context.Context, filter any) error {
+	err := collection.next.DeleteOne(ctx, filter)
+	collection.invalidate(ctx, filter)
+	return err
+}
+
+func (collection *dbCollection) FindSome(ctx context.Context, filter any, limit int, results any) error {
+	return collection.next.FindSome(ctx, filter, limit, results)
+}
+
+func (collection *dbCollection) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, results any) error {
+	return collection.next.FindSorted(ctx, filter, sort, skip, limit, results)
+}
+
+func (collection *dbCollection) Search(ctx context.Context, query string, filter any, limit int, results any) error {
+	return collection.next.Search(ctx, query, filter, limit, results)
+}
+
+func (collection *dbCollection) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	err := collection.next.IncrementOne(ctx, filter, field, by)
+	if err != nil {
+		collection.invalidate(ctx, filter)
+		return err
+	}
+	collection.increment(ctx, filter, field, by)
+	return nil
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// in-process LRU cache (implements ICache)
+type LRU struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// create LRU holding up to size entries
+func NewLRU(size int) *LRU {
+	return &LRU{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// LRU methods
+
+func (lru *LRU) Get(ctx context.Context, key string) ([]byte, error) {
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+	elem, ok := lru.entries[key]
+	if !ok {
+		return nil, ErrMiss
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		lru.remove(elem)
+		return nil, ErrMiss
+	}
+	lru.order.MoveToFront(elem)
+	return entry.value, nil
+}
+
+func (lru *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+	if elem, ok := lru.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = time.Now().Add(ttl)
+		lru.order.MoveToFront(elem)
+		return nil
+	}
+	lru.entries[key] = lru.order.PushFront(&lruEntry{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(ttl),
+	})
+	// evict least recently used
+	for lru.order.Len() > lru.size {
+		lru.remove(lru.order.Back())
+	}
+	return nil
+}
+
+func (lru *LRU) Delete(ctx context.Context, key string) error {
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+	if elem, ok := lru.entries[key]; ok {
+		lru.remove(elem)
+	}
+	return nil
+}
+
+// number of entries (including expired ones not evicted yet)
+func (lru *LRU) Len() int {
+	lru.mutex.Lock()
+	defer lru.mutex.Unlock()
+	return lru.order.Len()
+}
+
+func (lru *LRU) remove(elem *list.Element) {
+	lru.order.Remove(elem)
+	delete(lru.entries, elem.Value.(*lruEntry).key)
+}
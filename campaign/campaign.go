@@ -0,0 +1,101 @@
+package campaign
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// campaign names appear in urls
+var nameFormat = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// utm parameters a link may set (without utm_ prefix)
+var UTMKeys = []string{"source", "medium", "campaign", "term", "content"}
+
+var ErrInvalidName = errors.New("campaign name must be 1-64 letters, digits, '.', '_' or '-'")
+
+// marketing campaign, stored in its own collection
+// links refer to it by name and inherit its utm defaults
+// omitempty is required for db filters
+type Campaign struct {
+	ID        string    `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name      string    `json:"name" bson:"name,omitempty"`
+	Workspace string    `json:"-" bson:"workspace,omitempty"` // names are unique per workspace
+	Source    string    `json:"utm_source,omitempty" bson:"source,omitempty"`
+	Medium    string    `json:"utm_medium,omitempty" bson:"medium,omitempty"`
+	Campaign  string    `json:"utm_campaign,omitempty" bson:"campaign,omitempty"` // name if empty
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+}
+
+// functions
+
+// check name and fill defaults
+func (c *Campaign) Normalize() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if !nameFormat.MatchString(c.Name) {
+		return ErrInvalidName
+	}
+	if c.Campaign == "" {
+		c.Campaign = c.Name
+	}
+	return nil
+}
+
+// default utm parameters of campaign
+func (c *Campaign) UTM() map[string]string {
+	return map[string]string{
+		"source":   c.Source,
+		"medium":   c.Medium,
+		"campaign": c.Campaign,
+	}
+}
+
+// check that utm map only has known keys
+func ValidateUTM(utm map[string]string) error {
+	for key := range utm {
+		known := false
+		for _, k := range UTMKeys {
+			known = known || k == key
+		}
+		if !known {
+			return fmt.Errorf("unknown utm parameter %q, expected one of %s", key, strings.Join(UTMKeys, ", "))
+		}
+	}
+	return nil
+}
+
+// add utm_* parameters to raw url
+// parameters already present in the url win over overrides, overrides win over defaults
+// existing query is kept as is, missing parameters are appended
+func MergeUTM(raw string, overrides map[string]string, defaults map[string]string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	extra := url.Values{}
+	for _, key := range UTMKeys {
+		name := "utm_" + key
+		if query.Has(name) {
+			continue
+		}
+		value := overrides[key]
+		if value == "" {
+			value = defaults[key]
+		}
+		if value != "" {
+			extra.Set(name, value)
+		}
+	}
+	if len(extra) == 0 {
+		return raw, nil
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += extra.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,57 @@
+package campaign
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	c := Campaign{Name: " spring-2024 ", Source: "newsletter"}
+	if err := c.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "spring-2024" || c.Campaign != "spring-2024" {
+		t.Errorf("invalid defaults %v", c)
+	}
+	for _, name := range []string{"", "with space", "slash/name"} {
+		c := Campaign{Name: name}
+		if err := c.Normalize(); err != ErrInvalidName {
+			t.Errorf("invalid name %q accepted", name)
+		}
+	}
+}
+
+func TestMergeUTM(t *testing.T) {
+	defaults := map[string]string{"source": "newsletter", "medium": "email", "campaign": "spring"}
+	cases := []struct {
+		raw       string
+		overrides map[string]string
+		expected  string
+	}{
+		{"http://someurl/path", nil, "http://someurl/path?utm_campaign=spring&utm_medium=email&utm_source=newsletter"},
+		// existing query is kept as is
+		{"http://someurl/?b=2&a=1", nil, "http://someurl/?b=2&a=1&utm_campaign=spring&utm_medium=email&utm_source=newsletter"},
+		// url wins over overrides, overrides win over defaults
+		{"http://someurl/?utm_source=site", map[string]string{"source": "ads", "medium": "cpc", "term": "shoes"},
+			"http://someurl/?utm_source=site&utm_campaign=spring&utm_medium=cpc&utm_term=shoes"},
+		{"http://someurl/#top", nil, "http://someurl/?utm_campaign=spring&utm_medium=email&utm_source=newsletter#top"},
+	}
+	for _, c := range cases {
+		merged, err := MergeUTM(c.raw, c.overrides, defaults)
+		if err != nil {
+			t.Errorf("%s: %v", c.raw, err)
+		}
+		if merged != c.expected {
+			t.Errorf("%s: invalid result %s", c.raw, merged)
+		}
+	}
+	if merged, _ := MergeUTM("http://someurl/?utm_source=a&utm_medium=b&utm_campaign=c", nil, defaults); merged != "http://someurl/?utm_source=a&utm_medium=b&utm_campaign=c" {
+		t.Errorf("url shouldn't change: %s", merged)
+	}
+}
+
+func TestValidateUTM(t *testing.T) {
+	if err := ValidateUTM(map[string]string{"source": "a", "term": "b"}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateUTM(map[string]string{"utm_source": "a"}); err == nil {
+		t.Error("unknown parameter accepted")
+	}
+}
@@ -0,0 +1,184 @@
+package clicks
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+	"url-shortener/db_interface"
+	"url-shortener/metrics"
+	"url-shortener/url_data"
+)
+
+const accessCountField = "accessCount"
+
+// clicks per variant are counted in subfields of this one
+const variantClicksField = "variantClicks"
+
+// buffered click aggregator
+// accumulates clicks per short code in memory and flushes them
+// to the db in batches, every interval or once threshold clicks are pending
+type Aggregator struct {
+	db        db_interface.IDBCollection
+	interval  time.Duration
+	threshold int
+
+	mutex    sync.Mutex
+	pending  map[link]int            // link -> clicks
+	variants map[link]map[string]int // link -> variant -> clicks
+	backlog  int                     // sum of pending
+
+	flush_req chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// short code on a domain, empty for the default domain
+type link struct {
+	domain     string
+	short_code string
+}
+
+// create aggregator, call Start() to run periodic flushes
+func NewAggregator(db db_interface.IDBCollection, interval time.Duration, threshold int) *Aggregator {
+	return &Aggregator{
+		db:        db,
+		interval:  interval,
+		threshold: threshold,
+		pending:   make(map[link]int),
+		variants:  make(map[link]map[string]int),
+		flush_req: make(chan struct{}, 1),
+	}
+}
+
+// Aggregator methods
+
+// count a click on short code of domain
+func (a *Aggregator) Add(domain string, short_code string) {
+	a.AddVariant(domain, short_code, "")
+}
+
+// count a click on a variant of the short code, empty variant counts the click only
+func (a *Aggregator) AddVariant(domain string, short_code string, variant string) {
+	key := link{domain, short_code}
+	a.mutex.Lock()
+	a.pending[key]++
+	a.backlog++
+	if variant != "" {
+		if a.variants[key] == nil {
+			a.variants[key] = make(map[string]int)
+		}
+		a.variants[key][variant]++
+	}
+	backlog := a.backlog
+	a.mutex.Unlock()
+	metrics.SetClickBacklog(backlog)
+	if a.threshold > 0 && backlog >= a.threshold {
+		// request flush without blocking the caller
+		select {
+		case a.flush_req <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// clicks of short code not flushed yet
+func (a *Aggregator) Pending(domain string, short_code string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.pending[link{domain, short_code}]
+}
+
+// clicks per variant of short code not flushed yet
+func (a *Aggregator) PendingVariants(domain string, short_code string) map[string]int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return maps.Clone(a.variants[link{domain, short_code}])
+}
+
+// total number of clicks not flushed yet
+func (a *Aggregator) Backlog() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.backlog
+}
+
+// write pending clicks to the db
+// clicks which failed to be written are kept for the next flush
+func (a *Aggregator) Flush(ctx context.Context) {
+	a.mutex.Lock()
+	batch, variant_batch := a.pending, a.variants
+	a.pending = make(map[link]int)
+	a.variants = make(map[link]map[string]int)
+	a.backlog = 0
+	a.mutex.Unlock()
+
+	flushed := 0
+	for key, n := range batch {
+		filter := url_data.ByCode(key.domain, key.short_code)
+		err := a.db.IncrementOne(ctx, filter, accessCountField, n)
+		switch err {
+		case nil:
+			flushed += n
+		case db_interface.ErrNoDocuments:
+			// record was deleted meanwhile, drop its clicks
+			slog.DebugContext(ctx, "dropping clicks of missing record", "domain", key.domain, "code", key.short_code, "clicks", n)
+			continue
+		default:
+			slog.WarnContext(ctx, "couldn't flush clicks, will retry", "domain", key.domain, "code", key.short_code, "clicks", n, "error", err)
+			a.mutex.Lock()
+			a.pending[key] += n
+			a.backlog += n
+			a.mutex.Unlock()
+		}
+		// variant clicks are retried on their own, they're part of the clicks above
+		for variant, vn := range variant_batch[key] {
+			err := a.db.IncrementOne(ctx, filter, variantClicksField+"."+variant, vn)
+			if err != nil && err != db_interface.ErrNoDocuments {
+				slog.WarnContext(ctx, "couldn't flush variant clicks, will retry", "domain", key.domain, "code", key.short_code, "variant", variant, "clicks", vn, "error", err)
+				a.mutex.Lock()
+				if a.variants[key] == nil {
+					a.variants[key] = make(map[string]int)
+				}
+				a.variants[key][variant] += vn
+				a.mutex.Unlock()
+			}
+		}
+	}
+	metrics.AddClicksFlushed(flushed)
+	metrics.SetClickBacklog(a.Backlog())
+}
+
+// run periodic flushes in background
+func (a *Aggregator) Start() {
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-a.flush_req:
+			case <-a.stop:
+				return
+			}
+			a.Flush(context.Background())
+		}
+	}()
+}
+
+// stop background flushes and flush what's left
+func (a *Aggregator) Stop(ctx context.Context) {
+	if a.stop != nil {
+		close(a.stop)
+		<-a.done
+		a.stop = nil
+	}
+	a.Flush(ctx)
+	if backlog := a.Backlog(); backlog > 0 {
+		slog.ErrorContext(ctx, "clicks lost on shutdown", "clicks", backlog)
+	}
+}
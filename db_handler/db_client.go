@@ -22,9 +22,16 @@ func (client *DBClient) Disconnect() error {
 	return client.handle.Disconnect(context.Background())
 }
 
+// check that db is reachable
+func (client *DBClient) Ping(ctx context.Context) error {
+	ctx, cancel := getContext(ctx)
+	defer cancel()
+	return client.handle.Ping(ctx, nil)
+}
+
 // get db names
 func (client *DBClient) GetDBNames() (dbs []string, err error) {
-	ctx, cancel := getContext()
+	ctx, cancel := getContext(context.Background())
 	defer cancel()
 	return client.handle.ListDatabaseNames(ctx, bson.D{})
 }
@@ -1,7 +1,11 @@
 package db_handler
 
 import (
+	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"url-shortener/db_interface"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,36 +20,52 @@ type DBCollection struct {
 }
 
 // helpers
+// nil values of the newer version are removed
 func genUpdateDoc(orig, upd bson.M) bson.M {
 	// diff bson
 	diff := bson.M{}
+	removed := bson.M{}
 	// iterate over newer version
 	for k, newVal := range upd {
 		if origVal, exists := orig[k]; !exists || origVal != newVal {
-			diff[k] = newVal
+			if newVal == nil {
+				removed[k] = ""
+			} else {
+				diff[k] = newVal
+			}
 		}
 	}
 	// If diff is empty, return nil
-	if len(diff) == 0 {
+	if len(diff) == 0 && len(removed) == 0 {
 		return nil
 	}
 	// mongo needs an update doc with $ key
-	return bson.M{"$set": diff}
+	update := bson.M{}
+	if len(diff) > 0 {
+		update["$set"] = diff
+	}
+	if len(removed) > 0 {
+		update["$unset"] = removed
+	}
+	return update
 }
 
 // DBCollection methods
 
 // insert one doc into collection
-func (collection *DBCollection) InsertOne(doc any) (id string, err error) {
+func (collection *DBCollection) InsertOne(ctx context.Context, doc any) (id string, err error) {
 	var bsonDoc any
 	// convert doc to bson
 	bsonDoc, err = bson.Marshal(doc)
 	if err != nil {
 		return "", fmt.Errorf("failed to convert struct to BSON: %v", err)
 	}
-	ctx, cancel := getContext()
+	ctx, cancel := getContext(ctx)
 	defer cancel()
 	result, err := collection.mongo_collection.InsertOne(ctx, bsonDoc)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", db_interface.ErrDuplicateKey
+	}
 	if err == nil {
 		if objectID, ok := result.InsertedID.(primitive.ObjectID); ok {
 			id = objectID.Hex()
@@ -57,27 +77,26 @@ func (collection *DBCollection) InsertOne(doc any) (id string, err error) {
 }
 
 // find doc with filter
-func (collection *DBCollection) FindOne(filter any, result any) error {
-	var res bson.M
+func (collection *DBCollection) FindOne(ctx context.Context, filter any, result any) error {
 	bson_filter, err := bsonFromAny(filter)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := getContext()
+	ctx, cancel := getContext(ctx)
 	defer cancel()
-	err = collection.mongo_collection.FindOne(ctx, bson_filter).Decode(&res)
+	// decode by bson tags, so that fields hidden from json (e.g. hashes) are loaded too
+	err = collection.mongo_collection.FindOne(ctx, bson_filter).Decode(result)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return db_interface.ErrNoDocuments
 		}
 		return err
 	}
-
-	return convertBsonToJson(res, &result)
+	return nil
 }
 
 // update doc
-func (collection *DBCollection) UpdateOne(old any, new any) error {
+func (collection *DBCollection) UpdateOne(ctx context.Context, old any, new any) error {
 	old_doc, err := bsonFromAny(old)
 	if err != nil {
 		return err
@@ -91,27 +110,49 @@ func (collection *DBCollection) UpdateOne(old any, new any) error {
 	if update == nil {
 		return fmt.Errorf("no changes introduced")
 	}
-	ctx, cancel := getContext()
+	ctx, cancel := getContext(ctx)
 	defer cancel()
-	var res bson.M
-	err = collection.mongo_collection.FindOneAndUpdate(ctx, old_doc, update).Decode(&res)
+	// return updated doc
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = collection.mongo_collection.FindOneAndUpdate(ctx, old_doc, update, opts).Decode(new)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return db_interface.ErrNoDocuments
 		}
 		return err
 	}
+	return nil
+}
 
-	return convertBsonToJson(res, &new)
+// replace doc
+func (collection *DBCollection) ReplaceOne(ctx context.Context, filter any, replacement any) error {
+	bson_filter, err := bsonFromAny(filter)
+	if err != nil {
+		return err
+	}
+	doc, err := bsonFromAny(replacement)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := getContext(ctx)
+	defer cancel()
+	res, err := collection.mongo_collection.ReplaceOne(ctx, bson_filter, doc)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db_interface.ErrNoDocuments
+	}
+	return nil
 }
 
 // delete doc
-func (collection *DBCollection) DeleteOne(filter any) error {
+func (collection *DBCollection) DeleteOne(ctx context.Context, filter any) error {
 	bson_filter, err := bsonFromAny(filter)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := getContext()
+	ctx, cancel := getContext(ctx)
 	defer cancel()
 	res, err := collection.mongo_collection.DeleteOne(ctx, bson_filter)
 	if err != nil {
@@ -126,12 +167,127 @@ func (collection *DBCollection) DeleteOne(filter any) error {
 	return nil
 }
 
+// increment numeric field
+func (collection *DBCollection) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	bson_filter, err := bsonFromAny(filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := getContext(ctx)
+	defer cancel()
+	res, err := collection.mongo_collection.UpdateOne(ctx, bson_filter, bson.M{"$inc": bson.M{field: by}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db_interface.ErrNoDocuments
+	}
+	return nil
+}
+
+// create ascending (compound) index on fields unless it exists
+func (collection *DBCollection) EnsureIndex(fields ...string) error {
+	return collection.ensureIndex(false, fields)
+}
+
+// same as EnsureIndex, but inserting duplicates fails with ErrDuplicateKey
+func (collection *DBCollection) EnsureUniqueIndex(fields ...string) error {
+	return collection.ensureIndex(true, fields)
+}
+
+func (collection *DBCollection) ensureIndex(unique bool, fields []string) error {
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: 1})
+	}
+	ctx, cancel := getContext(context.Background())
+	defer cancel()
+	_, err := collection.mongo_collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetUnique(unique),
+	})
+	return err
+}
+
+// create index expiring documents once the time in field has passed
+// documents without the field never expire
+func (collection *DBCollection) EnsureTTLIndex(field string) error {
+	ctx, cancel := getContext(context.Background())
+	defer cancel()
+	_, err := collection.mongo_collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// create text index with relative weights of fields, used by Search
+// there can only be one text index per collection
+func (collection *DBCollection) EnsureTextIndex(weights map[string]int) error {
+	keys := bson.D{}
+	bson_weights := bson.M{}
+	// index name is made of the keys, sorted so that it's the same on every start
+	for _, field := range slices.Sorted(maps.Keys(weights)) {
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+		bson_weights[field] = weights[field]
+	}
+	ctx, cancel := getContext(context.Background())
+	defer cancel()
+	_, err := collection.mongo_collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    keys,
+		Options: options.Index().SetWeights(bson_weights),
+	})
+	return err
+}
+
+// full-text search (result is a pointer to slice), ranked by text score
+func (collection *DBCollection) Search(ctx context.Context, query string, filter any, limit int, result any) error {
+	bson_filter := bson.M{}
+	if filter != nil {
+		var err error
+		if bson_filter, err = bsonFromAny(filter); err != nil {
+			return err
+		}
+	}
+	bson_filter["$text"] = bson.M{"$search": query}
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	opts := options.Find().SetProjection(score).SetSort(score).SetLimit(int64(limit))
+	ctx, cancel := getContext(ctx)
+	defer cancel()
+	cursor, err := collection.mongo_collection.Find(ctx, bson_filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, result)
+}
+
 // find some (result is a pointer to slice)
-func (collection *DBCollection) FindSome(limit int, result any) error {
-	opts := options.Find().SetLimit(int64(limit))
-	ctx, cancel := getContext()
+func (collection *DBCollection) FindSome(ctx context.Context, filter any, limit int, result any) error {
+	return collection.find(ctx, filter, options.Find().SetLimit(int64(limit)), result)
+}
+
+// find some ordered by field, descending if it's prefixed with '-'
+func (collection *DBCollection) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, result any) error {
+	order := 1
+	if field, desc := strings.CutPrefix(sort, "-"); desc {
+		sort, order = field, -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: sort, Value: order}}).SetSkip(int64(skip)).SetLimit(int64(limit))
+	return collection.find(ctx, filter, opts, result)
+}
+
+func (collection *DBCollection) find(ctx context.Context, filter any, opts *options.FindOptions, result any) error {
+	bson_filter := bson.M{}
+	if filter != nil {
+		var err error
+		if bson_filter, err = bsonFromAny(filter); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := getContext(ctx)
 	defer cancel()
-	cursor, err := collection.mongo_collection.Find(ctx, bson.M{}, opts)
+	cursor, err := collection.mongo_collection.Find(ctx, bson_filter, opts)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return db_interface.ErrNoDocuments
@@ -20,13 +20,14 @@ func SetTimeout(tmt int) {
 	db_timeout = time.Duration(tmt)
 }
 
-func getContext() (context.Context, context.CancelFunc) {
-	return context.WithTimeout(context.Background(), db_timeout*time.Second)
+// derive a context bounded by db timeout
+func getContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, db_timeout*time.Second)
 }
 
 // connect to db
 func Connect(host string, port int) (*DBClient, error) {
-	ctx, cancel := getContext()
+	ctx, cancel := getContext(context.Background())
 	defer cancel()
 	opts := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%d/", host, port))
 	handle, err := mongo.Connect(ctx, opts)
@@ -1,7 +1,6 @@
 package db_handler
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -10,14 +9,6 @@ import (
 
 // helpers
 
-func convertBsonToJson(bson_doc bson.M, result any) error {
-	jsonData, err := json.Marshal(bson_doc)
-	if err != nil {
-		return fmt.Errorf("failed to convert doc to JSON: %v", err)
-	}
-	return json.Unmarshal(jsonData, &result)
-}
-
 func bsonFromAny(s any) (bson.M, error) {
 	data, err := bson.Marshal(s)
 	if err != nil {
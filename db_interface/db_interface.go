@@ -1,14 +1,35 @@
 package db_interface
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 // db interface
+// ctx carries request scoped values (deadlines, trace spans)
 type IDBCollection interface {
-	InsertOne(doc any) (id string, err error)
-	FindOne(filter any, result any) error
-	UpdateOne(filter any, update_with any) error
-	DeleteOne(filter any) error
-	FindSome(limit int, results any) error
+	InsertOne(ctx context.Context, doc any) (id string, err error)
+	FindOne(ctx context.Context, filter any, result any) error
+	UpdateOne(ctx context.Context, filter any, update_with any) error
+	// replace whole matching doc (fields absent from replacement are removed)
+	ReplaceOne(ctx context.Context, filter any, replacement any) error
+	DeleteOne(ctx context.Context, filter any) error
+	// filter may be nil to match any doc
+	FindSome(ctx context.Context, filter any, limit int, results any) error
+	// same as FindSome, ordered by field (descending if prefixed with '-'), skipping the first skip docs
+	FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, results any) error
+	// atomically add by to numeric field of matching doc
+	IncrementOne(ctx context.Context, filter any, field string, by int) error
+	// full-text search over indexed fields among docs matching filter (may be nil), most relevant docs first
+	Search(ctx context.Context, query string, filter any, limit int, results any) error
+}
+
+// db connectivity check interface
+type IDBPinger interface {
+	Ping(ctx context.Context) error
 }
 
 var ErrNoDocuments = errors.New("no records found")
+
+// unique index violated
+var ErrDuplicateKey = errors.New("record already exists")
@@ -2,20 +2,48 @@ const backUrl = "/shorten";
 const saveBtn = document.getElementById("saveBtn");
 const searchBtn = document.getElementById("searchBtn");
 const listBtn = document.getElementById("listBtn");
+const qrBtn = document.getElementById("qrBtn");
+const findInput = document.getElementById("findInput");
+const findBtn = document.getElementById("findBtn");
 const urlInput = document.getElementById("urlInput");
 const responseMsg = document.getElementById("responseMsg");
+const accountForm = document.getElementById("accountForm");
+const nameInput = document.getElementById("nameInput");
+const passwordInput = document.getElementById("passwordInput");
+const loginBtn = document.getElementById("loginBtn");
+const registerBtn = document.getElementById("registerBtn");
+const signedIn = document.getElementById("signedIn");
+const userName = document.getElementById("userName");
+const logoutBtn = document.getElementById("logoutBtn");
+
+// csrf token of the session, required along with changes
+let csrfToken = null;
 
 async function genericRequest(url, method, body = null) {
     const options = {
         method: method,
         headers: {"Content-Type": "application/json"},
     };
+    if (csrfToken) {
+        options.headers["X-CSRF-Token"] = csrfToken;
+    }
     if (body) {
         options.body = body;
     }
     const response = await fetch(url, options);
     if (!response.ok) {
-        throw new Error(await response.text());
+        const text = await response.text();
+        let message = text;
+        try {
+            const err = JSON.parse(text);
+            message = `${err.error} (request id ${err.requestId})`;
+        } catch (e) {
+            // not a json error, show as is
+        }
+        throw new Error(message);
+    }
+    if (response.status === 204) {
+        return null;
     }
     const data = await response.json();
     console.log(`Response ${response.status} ${response.statusText}\n` + JSON.stringify(data));
@@ -43,7 +71,7 @@ saveBtn.addEventListener("click", () =>
         new URL(url);
 
         const data = await genericRequest(`${backUrl}`, "POST", JSON.stringify({url}));
-        responseMsg.innerText = `Saved as ${data.shortCode}`
+        responseMsg.innerText = `Saved as ${data.shortUrl || data.shortCode}`
         urlInput.value = '' // clear input field
 }));
 
@@ -77,4 +105,92 @@ listBtn.addEventListener("click", () =>
             result += `${element.shortCode}: ${element.url}\n`;
         }
         responseMsg.innerText = result;
-}));
\ No newline at end of file
+}));
+
+// handle qr code download
+qrBtn.addEventListener("click", () =>
+    errorHandler(async() => {
+        const key = urlInput.value;
+        if (!key) {
+            alert("Please enter a valid key");
+            return;
+        }
+        const response = await fetch(`${backUrl}/${key}/qr?format=png&size=512`);
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        // save image via temporary link
+        const link = document.createElement("a");
+        link.href = URL.createObjectURL(await response.blob());
+        link.download = `${key}.png`;
+        link.click();
+        URL.revokeObjectURL(link.href);
+        responseMsg.innerText = `QR code for ${key} downloaded`;
+}));
+// handle search
+async function find() {
+    const query = findInput.value.trim();
+    if (!query) {
+        alert("Please enter a search query");
+        return;
+    }
+    const data = await genericRequest(`${backUrl}/search?q=${encodeURIComponent(query)}`, "GET");
+    let result = data.length ? "Found:\n" : "Nothing found";
+    for (const element of data) {
+        const title = element.title ? ` (${element.title})` : "";
+        result += `${element.shortCode}: ${element.url}${title}\n`;
+    }
+    responseMsg.innerText = result;
+}
+
+findBtn.addEventListener("click", () => errorHandler(find));
+findInput.addEventListener("keydown", (event) => {
+    if (event.key === "Enter") {
+        errorHandler(find);
+    }
+});
+
+// handle accounts
+function showSession(session) {
+    csrfToken = session ? session.csrfToken : null;
+    accountForm.hidden = !!session;
+    signedIn.hidden = !session;
+    userName.innerText = session ? `${session.user} (${session.workspace})` : "";
+}
+
+async function signIn(action) {
+    const name = nameInput.value.trim();
+    const password = passwordInput.value;
+    if (!name || !password) {
+        alert("Please enter user name and password");
+        return;
+    }
+    const session = await genericRequest(`/auth/${action}`, "POST", JSON.stringify({name, password}));
+    passwordInput.value = '' // clear password field
+    showSession(session);
+    responseMsg.innerText = `Signed in as ${session.user}`;
+}
+
+loginBtn.addEventListener("click", () => errorHandler(() => signIn("login")));
+registerBtn.addEventListener("click", () => errorHandler(() => signIn("register")));
+passwordInput.addEventListener("keydown", (event) => {
+    if (event.key === "Enter") {
+        errorHandler(() => signIn("login"));
+    }
+});
+
+logoutBtn.addEventListener("click", () =>
+    errorHandler(async() => {
+        await genericRequest("/auth/logout", "POST");
+        showSession(null);
+        responseMsg.innerText = "Signed out";
+}));
+
+// resume session of the cookie, the form is only shown if accounts are enabled
+fetch("/auth/session").then(async(response) => {
+    if (response.ok) {
+        showSession(await response.json());
+    } else if (response.status === 401) {
+        showSession(null);
+    }
+}).catch((error) => console.error("Error: ", error));
@@ -0,0 +1,139 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ip range of a country
+type block struct {
+	first   netip.Addr
+	last    netip.Addr
+	country string
+}
+
+// local country database, loaded once and looked up in memory
+// supported CSV rows (header and # comments are skipped):
+//
+//	network,country            e.g. 203.0.113.0/24,AU
+//	first ip,last ip,country   e.g. 1.0.0.0,1.0.0.255,AU (DB-IP lite format)
+type DB struct {
+	blocks []block // sorted by first
+}
+
+// functions
+
+// load database from CSV file
+func Open(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Load(file)
+}
+
+// load database from CSV data
+func Load(r io.Reader) (*DB, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	db := &DB{}
+	for line := 1; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := parseRow(row)
+		if err != nil {
+			// first row may be a header
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		db.blocks = append(db.blocks, b)
+	}
+	sort.Slice(db.blocks, func(i, j int) bool {
+		return db.blocks[i].first.Less(db.blocks[j].first)
+	})
+	return db, nil
+}
+
+func parseRow(row []string) (block, error) {
+	switch len(row) {
+	case 2:
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[0]))
+		if err != nil {
+			return block{}, err
+		}
+		prefix = prefix.Masked()
+		return newBlock(prefix.Addr(), lastOf(prefix), row[1])
+	case 3:
+		first, err := netip.ParseAddr(strings.TrimSpace(row[0]))
+		if err != nil {
+			return block{}, err
+		}
+		last, err := netip.ParseAddr(strings.TrimSpace(row[1]))
+		if err != nil {
+			return block{}, err
+		}
+		return newBlock(first, last, row[2])
+	}
+	return block{}, fmt.Errorf("expected 2 or 3 columns, got %d", len(row))
+}
+
+func newBlock(first, last netip.Addr, country string) (block, error) {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if len(country) != 2 {
+		return block{}, fmt.Errorf("invalid country code %q", country)
+	}
+	if first.Is4() != last.Is4() || last.Less(first) {
+		return block{}, errors.New("invalid ip range")
+	}
+	return block{first: first, last: last, country: country}, nil
+}
+
+// last address of prefix
+func lastOf(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(bytes)
+	return last
+}
+
+// DB methods
+
+// ISO country code of ip, empty if unknown
+func (db *DB) Country(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	// last block starting at or before addr
+	i := sort.Search(len(db.blocks), func(i int) bool {
+		return addr.Less(db.blocks[i].first)
+	}) - 1
+	if i < 0 || db.blocks[i].last.Less(addr) || db.blocks[i].first.Is4() != addr.Is4() {
+		return ""
+	}
+	return db.blocks[i].country
+}
+
+// number of ip ranges
+func (db *DB) Len() int {
+	return len(db.blocks)
+}
@@ -0,0 +1,55 @@
+package geoip
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDB = `network,country
+# comment
+203.0.113.0/24,au
+1.0.0.0,1.0.0.255,AU
+2001:db8::/32,DE
+198.51.100.0/25,US
+`
+
+func TestCountry(t *testing.T) {
+	db, err := Load(strings.NewReader(testDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Len() != 4 {
+		t.Errorf("invalid number of ranges %d", db.Len())
+	}
+	countries := map[string]string{
+		"203.0.113.7":        "AU",
+		"203.0.113.255":      "AU",
+		"203.0.114.0":        "",
+		"1.0.0.128":          "AU",
+		"198.51.100.127":     "US",
+		"198.51.100.128":     "",
+		"2001:db8::1":        "DE",
+		"::ffff:203.0.113.7": "AU",
+		"10.0.0.1":           "",
+		"not an ip":          "",
+	}
+	for ip, ref := range countries {
+		if country := db.Country(ip); country != ref {
+			t.Errorf("invalid country %q for %s", country, ip)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	rows := []string{
+		"network,country\n203.0.113.0/24,AUS\n",
+		"network,country\n203.0.113.0/33,AU\n",
+		"network,country\n1.0.0.255,1.0.0.0,AU\n",
+		"network,country\n1.0.0.0,2001:db8::,AU\n",
+	}
+	for _, data := range rows {
+		if _, err := Load(strings.NewReader(data)); err == nil {
+			t.Errorf("invalid data accepted: %q", data)
+		}
+	}
+}
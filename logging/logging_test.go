@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactJSON(t *testing.T) {
+	res := RedactJSON([]byte(`{"url":"http://someurl","password":"hunter2","nested":[{"apiKey":"k"}],"sig":"s","signedOnly":true}`))
+	if strings.Contains(res, "hunter2") || strings.Contains(res, `"k"`) || strings.Contains(res, `"s"`) {
+		t.Errorf("sensitive data leaked: %s", res)
+	}
+	if !strings.Contains(res, "http://someurl") || !strings.Contains(res, `"signedOnly":true`) {
+		t.Errorf("regular data removed: %s", res)
+	}
+	if res := RedactJSON([]byte("not json")); res != "not json" {
+		t.Errorf("non-json data changed: %s", res)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	if err := Setup("verbose", "text", &bytes.Buffer{}); err == nil {
+		t.Error("should reject unknown level")
+	}
+	if err := Setup("info", "xml", &bytes.Buffer{}); err == nil {
+		t.Error("should reject unknown format")
+	}
+
+	var buf bytes.Buffer
+	if err := Setup("info", "json", &buf); err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithRequestID(context.Background(), "req-42")
+	slog.DebugContext(ctx, "hidden")
+	slog.InfoContext(ctx, "shown", "token", "secret-value")
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("debug record written at info level: %s", out)
+	}
+	if !strings.Contains(out, `"request_id":"req-42"`) {
+		t.Errorf("request id missing: %s", out)
+	}
+	if strings.Contains(out, "secret-value") {
+		t.Errorf("sensitive attribute leaked: %s", out)
+	}
+}
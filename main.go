@@ -1,33 +1,86 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"flag"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 	"url-shortener/backend"
+	"url-shortener/cache"
 	"url-shortener/db_handler"
+	"url-shortener/geoip"
+	"url-shortener/logging"
+	"url-shortener/metrics"
+	"url-shortener/tracing"
+	"url-shortener/url_data"
+	"url-shortener/url_signer"
+	"url-shortener/workspace"
 )
 
 func main() {
 
+	shutdown_delay := flag.Duration("shutdown-delay", 5*time.Second, "how long readiness fails before the server shuts down")
+	log_level := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	log_format := flag.String("log-format", "text", "log format: text or json")
+	trace_exporter := flag.String("trace-exporter", "none", "trace exporter: none, stdout or otlp")
+	trace_endpoint := flag.String("trace-endpoint", "", "OTLP/HTTP traces url, e.g. http://localhost:4318/v1/traces")
+	cache_size := flag.Int("cache-size", 10000, "number of short codes cached in-process, 0 disables caching")
+	cache_ttl := flag.Duration("cache-ttl", time.Minute, "how long resolved short codes are cached")
+	cache_negative_ttl := flag.Duration("cache-negative-ttl", 10*time.Second, "how long unknown short codes are cached")
+	click_flush_interval := flag.Duration("click-flush-interval", time.Second, "how often counted clicks are written to the db")
+	click_flush_threshold := flag.Int("click-flush-threshold", 1000, "number of pending clicks which triggers an early flush")
+	delete_retention := flag.Duration("delete-retention", 30*24*time.Hour, "how long deleted links can be restored before they're purged")
+	purge_interval := flag.Duration("purge-interval", time.Hour, "how often expired deleted links are purged")
+	reserve_deleted_codes := flag.Bool("reserve-deleted-codes", false, "never reissue short codes of purged links")
+	redis_url := flag.String("redis-url", "", "cache in Redis instead of in-process, e.g. redis://localhost:6379/0")
+	public_url := flag.String("public-url", "", "public base url of the service, e.g. https://sho.rt, default is the request scheme and host")
+	trust_proxy := flag.Bool("trust-proxy", false, "honor X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host, only behind a proxy which sets them")
+	domains := flag.String("domains", "", "comma-separated short domains, the first one is the default, e.g. go.acme.io,acme.link")
+	geoip_db := flag.String("geoip-db", "", "CSV file mapping ip ranges to countries, used by country routing rules")
+	multi_tenant := flag.Bool("workspaces", false, "require api keys and scope links to the workspace of the key")
+	session_ttl := flag.Duration("session-ttl", 7*24*time.Hour, "how long web sign-ins last")
+	registration := flag.Bool("registration", false, "let anyone register an account, which gets a workspace of its own")
+	registration_max_links := flag.Int("registration-max-links", 0, "active links of registered workspaces, 0 is unlimited")
+	registration_monthly_links := flag.Int("registration-monthly-links", 0, "links registered workspaces can create per month, 0 is unlimited")
+	registration_max_aliases := flag.Int("registration-max-aliases", 0, "custom short codes of registered workspaces, 0 is unlimited")
+	flag.Parse()
+
+	if err := logging.Setup(*log_level, *log_format, os.Stderr); err != nil {
+		slog.Error("invalid logging configuration", "error", err)
+		os.Exit(2)
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered from panic:", r)
+			slog.Error("recovered from panic", "error", r)
+		}
+	}()
+
+	trace_shutdown, err := tracing.Setup(context.Background(), *trace_exporter, *trace_endpoint)
+	if err != nil {
+		panic(err)
+	}
+	// flush spans upon exit
+	defer func() {
+		if err := trace_shutdown(context.Background()); err != nil {
+			slog.Error("couldn't flush traces", "error", err)
 		}
 	}()
 
-	fmt.Println("Connecting to db...")
+	slog.Info("connecting to db")
 	client, err := db_handler.Connect("localhost", 27017)
 	if err != nil {
 		panic(err)
 	}
 	// disconnect db upon exit
 	db_disconnect := func() {
-		fmt.Println("Disconnecting DB...")
+		slog.Info("disconnecting db")
 		if err = client.Disconnect(); err != nil {
-			log.Printf("Couldn't disconnect DB client: %v", err)
+			slog.Error("couldn't disconnect db client", "error", err)
 		}
 	}
 	defer db_disconnect()
@@ -41,9 +94,148 @@ func main() {
 		panic(err)
 	}
 
-	fmt.Println("Listening on port 8080...")
+	// short codes are unique per domain
+	if err := collection.EnsureUniqueIndex("domain", "shortCode"); err != nil {
+		panic(err)
+	}
+	// listing by tag and folder, campaign stats, purging
+	for _, index := range [][]string{{"tags"}, {"folder", "tags"}, {"campaign"}, {"deleted", "deletedAt"}} {
+		if err := collection.EnsureIndex(index...); err != nil {
+			panic(err)
+		}
+	}
+	if err := collection.EnsureTextIndex(url_data.SearchWeights); err != nil {
+		panic(err)
+	}
+
+	history, err := client.GetCollection("url_history")
+	if err != nil {
+		panic(err)
+	}
+	// latest history of short codes
+	if err := history.EnsureIndex("shortCode", "domain", "at"); err != nil {
+		panic(err)
+	}
+
+	campaigns, err := client.GetCollection("url_campaigns")
+	if err != nil {
+		panic(err)
+	}
+	// campaign names are unique per workspace
+	if err := campaigns.EnsureUniqueIndex("workspace", "name"); err != nil {
+		panic(err)
+	}
+
+	var db backend.DB = tracing.InstrumentDB(metrics.InstrumentDB(collection), "url_collection")
+	if *redis_url != "" {
+		redis, err := cache.NewRedis(*redis_url, "url-shortener:")
+		if err != nil {
+			panic(err)
+		}
+		defer redis.Close()
+		db = cache.WrapDB(db, redis, *cache_ttl, *cache_negative_ttl)
+	} else if *cache_size > 0 {
+		db = cache.WrapDB(db, cache.NewLRU(*cache_size), *cache_ttl, *cache_negative_ttl)
+	}
+
+	slog.Info("listening", "port", 8080)
+
+	backend.SetPinger(client)
+	backend.SetAuditCollection(tracing.InstrumentDB(metrics.InstrumentDB(history), "url_history"))
+	backend.SetCampaignCollection(tracing.InstrumentDB(metrics.InstrumentDB(campaigns), "url_campaigns"))
+	backend.SetShutdownDelay(*shutdown_delay)
+	backend.SetClickFlush(*click_flush_interval, *click_flush_threshold)
+	backend.SetDeletion(*delete_retention, *purge_interval, *reserve_deleted_codes)
+	if err := backend.SetPublicURL(*public_url); err != nil {
+		panic(err)
+	}
+	backend.SetTrustProxy(*trust_proxy)
+	if *domains != "" {
+		backend.SetDomains(strings.Split(*domains, ","))
+	}
+	if *geoip_db != "" {
+		countries, err := geoip.Open(*geoip_db)
+		if err != nil {
+			panic(err)
+		}
+		slog.Info("loaded geoip database", "ranges", countries.Len())
+		backend.SetGeoIP(countries)
+	}
+	// secrets are read from env rather than flags, so they don't show up in process lists
+	if keys := os.Getenv("SIGNING_KEYS"); keys != "" {
+		signer, err := url_signer.Parse(keys)
+		if err != nil {
+			panic(err)
+		}
+		backend.SetSigner(signer)
+	}
+	if *multi_tenant {
+		workspaces, err := client.GetCollection("url_workspaces")
+		if err != nil {
+			panic(err)
+		}
+		keys, err := client.GetCollection("url_api_keys")
+		if err != nil {
+			panic(err)
+		}
+		if err := workspaces.EnsureUniqueIndex("name"); err != nil {
+			panic(err)
+		}
+		if err := keys.EnsureUniqueIndex("hash"); err != nil {
+			panic(err)
+		}
+		if err := keys.EnsureIndex("workspace"); err != nil {
+			panic(err)
+		}
+		// listing within workspaces
+		for _, index := range [][]string{{"workspace", "tags"}, {"workspace", "folder", "tags"}} {
+			if err := collection.EnsureIndex(index...); err != nil {
+				panic(err)
+			}
+		}
+		usage, err := client.GetCollection("url_usage")
+		if err != nil {
+			panic(err)
+		}
+		if err := usage.EnsureUniqueIndex("key"); err != nil {
+			panic(err)
+		}
+		backend.SetWorkspaces(
+			tracing.InstrumentDB(metrics.InstrumentDB(workspaces), "url_workspaces"),
+			tracing.InstrumentDB(metrics.InstrumentDB(keys), "url_api_keys"),
+			os.Getenv("ADMIN_TOKEN"))
+		backend.SetUsageCollection(tracing.InstrumentDB(metrics.InstrumentDB(usage), "url_usage"))
+
+		users, err := client.GetCollection("url_users")
+		if err != nil {
+			panic(err)
+		}
+		sessions, err := client.GetCollection("url_sessions")
+		if err != nil {
+			panic(err)
+		}
+		if err := users.EnsureUniqueIndex("name"); err != nil {
+			panic(err)
+		}
+		if err := sessions.EnsureUniqueIndex("hash"); err != nil {
+			panic(err)
+		}
+		// expired sessions are removed by the db
+		if err := sessions.EnsureTTLIndex("expiresAt"); err != nil {
+			panic(err)
+		}
+		backend.SetAccounts(
+			tracing.InstrumentDB(metrics.InstrumentDB(users), "url_users"),
+			tracing.InstrumentDB(metrics.InstrumentDB(sessions), "url_sessions"),
+			*session_ttl)
+		backend.SetRegistration(*registration, workspace.Quotas{
+			MaxLinks:     *registration_max_links,
+			MonthlyLinks: *registration_monthly_links,
+			MaxAliases:   *registration_max_aliases,
+		})
+	}
 
-	go backend.Start(8080, collection)
+	go backend.Start(8080, db)
 
 	// add signal handler
 	quit := make(chan os.Signal, 1)                    // create a channel for signals
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"time"
+	"url-shortener/db_interface"
+)
+
+// IDBCollection decorator recording latency and errors per operation
+type dbCollection struct {
+	next db_interface.IDBCollection
+}
+
+// wrap collection with metrics
+func InstrumentDB(collection db_interface.IDBCollection) db_interface.IDBCollection {
+	return &dbCollection{next: collection}
+}
+
+// helpers
+func observe(operation string, start time.Time, err error) {
+	dbDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	// missing and duplicate documents are regular outcomes, not failures
+	if err != nil && err != db_interface.ErrNoDocuments && err != db_interface.ErrDuplicateKey {
+		dbErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// dbCollection methods
+
+func (collection *dbCollection) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	defer func(start time.Time) { observe("InsertOne", start, err) }(time.Now())
+	return collection.next.InsertOne(ctx, doc)
+}
+
+func (collection *dbCollection) FindOne(ctx context.Context, filter any, result any) (err error) {
+	defer func(start time.Time) { observe("FindOne", start, err) }(time.Now())
+	return collection.next.FindOne(ctx, filter, result)
+}
+
+func (collection *dbCollection) UpdateOne(ctx context.Context, filter any, update_with any) (err error) {
+	defer func(start time.Time) { observe("UpdateOne", start, err) }(time.Now())
+	return collection.next.UpdateOne(ctx, filter, update_with)
+}
+
+func (collection *dbCollection) ReplaceOne(ctx context.Context, filter any, replacement any) (err error) {
+	defer func(start time.Time) { observe("ReplaceOne", start, err) }(time.Now())
+	return collection.next.ReplaceOne(ctx, filter, replacement)
+}
+
+func (collection *dbCollection) DeleteOne(ctx context.Context, filter any) (err error) {
+	defer func(start time.Time) { observe("DeleteOne", start, err) }(time.Now())
+	return collection.next.DeleteOne(ctx, filter)
+}
+
+func (collection *dbCollection) FindSome(ctx context.Context, filter any, limit int, results any) (err error) {
+	defer func(start time.Time) { observe("FindSome", start, err) }(time.Now())
+	return collection.next.FindSome(ctx, filter, limit, results)
+}
+
+func (collection *dbCollection) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, results any) (err error) {
+	defer func(start time.Time) { observe("FindSorted", start, err) }(time.Now())
+	return collection.next.FindSorted(ctx, filter, sort, skip, limit, results)
+}
+
+func (collection *dbCollection) Search(ctx context.Context, query string, filter any, limit int, results any) (err error) {
+	defer func(start time.Time) { observe("Search", start, err) }(time.Now())
+	return collection.next.Search(ctx, query, filter, limit, results)
+}
+
+func (collection *dbCollection) IncrementOne(ctx context.Context, filter any, field string, by int) (err error) {
+	defer func(start time.Time) { observe("IncrementOne", start, err) }(time.Now())
+	return collection.next.IncrementOne(ctx, filter, field, by)
+}
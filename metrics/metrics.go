@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "url_shortener"
+
+// dedicated registry (avoids polluting prometheus.DefaultRegisterer)
+var registry = prometheus.NewRegistry()
+
+// collectors
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "DB operation latency by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_operation_errors_total",
+		Help:      "Number of failed DB operations by operation.",
+	}, []string{"operation"})
+
+	redirects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirects_total",
+		Help:      "Number of resolved short codes.",
+	})
+
+	collisionRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "short_code_collision_retries_total",
+		Help:      "Number of short code regenerations caused by collisions.",
+	})
+
+	clickBacklog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "click_backlog",
+		Help:      "Number of clicks counted in memory but not flushed to the DB yet.",
+	})
+
+	clicksFlushed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "clicks_flushed_total",
+		Help:      "Number of clicks flushed to the DB.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		dbDuration,
+		dbErrors,
+		redirects,
+		collisionRetries,
+		clickBacklog,
+		clicksFlushed,
+	)
+}
+
+// functions
+
+// http handler exposing metrics in prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// count resolved short code
+func IncRedirects() {
+	redirects.Inc()
+}
+
+// count short code regeneration
+func IncCollisionRetries() {
+	collisionRetries.Inc()
+}
+
+// report number of clicks not flushed yet
+func SetClickBacklog(n int) {
+	clickBacklog.Set(float64(n))
+}
+
+// count clicks flushed to the db
+func AddClicksFlushed(n int) {
+	clicksFlushed.Add(float64(n))
+}
+
+// response writer which remembers the status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// method label, arbitrary methods sent by clients are reported as OTHER
+func methodOf(r *http.Request) string {
+	switch r.Method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return r.Method
+	}
+	return "OTHER"
+}
+
+// middleware recording request count and latency
+// route maps a request to a low-cardinality route label
+func Middleware(route func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		labels := prometheus.Labels{
+			"route":  route(r),
+			"method": methodOf(r),
+			"status": strconv.Itoa(rec.status),
+		}
+		httpRequests.With(labels).Inc()
+		httpDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
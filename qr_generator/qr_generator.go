@@ -0,0 +1,84 @@
+package qr_generator
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const MinSize int = 64
+const MaxSize int = 2048
+
+// error correction levels by their QR names
+var eccLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,     // ~7%
+	"M": qrcode.Medium,  // ~15%
+	"Q": qrcode.High,    // ~25%
+	"H": qrcode.Highest, // ~30%
+}
+
+// content types by format
+var contentTypes = map[string]string{
+	"png": "image/png",
+	"svg": "image/svg+xml",
+}
+
+// helpers
+
+// render qr bitmap as svg, one rect per dark module
+func svg(q *qrcode.QRCode, size int) []byte {
+	bitmap := q.Bitmap() // includes quiet zone
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, len(bitmap), len(bitmap))
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="#fff"/>`)
+	buf.WriteString(`<path fill="#000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// functions
+
+// content type of format, empty if format is unknown
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// check size and ecc level of qr code
+func Validate(size int, ecc string) error {
+	if _, ok := eccLevels[ecc]; !ok {
+		return fmt.Errorf("invalid ecc level %q, expected one of L, M, Q, H", ecc)
+	}
+	if size < MinSize || size > MaxSize {
+		return fmt.Errorf("invalid size %d, expected %d..%d", size, MinSize, MaxSize)
+	}
+	return nil
+}
+
+// generate qr code encoding content
+// format is png or svg, size is width in pixels, ecc is one of L, M, Q, H
+func Generate(content string, format string, size int, ecc string) ([]byte, error) {
+	if err := Validate(size, ecc); err != nil {
+		return nil, err
+	}
+	q, err := qrcode.New(content, eccLevels[ecc])
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "png":
+		return q.PNG(size)
+	case "svg":
+		return svg(q, size), nil
+	default:
+		return nil, fmt.Errorf("invalid format %q, expected png or svg", format)
+	}
+}
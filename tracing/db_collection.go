@@ -0,0 +1,136 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"url-shortener/db_interface"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attribute holding filter field names (values are never recorded)
+const filterShapeKey = attribute.Key("db.filter.shape")
+
+// IDBCollection decorator starting a child span per operation
+type dbCollection struct {
+	next db_interface.IDBCollection
+	name string
+}
+
+// wrap collection with tracing, name is recorded as db.collection.name
+func InstrumentDB(collection db_interface.IDBCollection, name string) db_interface.IDBCollection {
+	return &dbCollection{next: collection, name: name}
+}
+
+// helpers
+
+// describe filter by its non-empty field names, e.g. {shortCode}
+func filterShape(filter any) string {
+	if filter == nil {
+		return "{}"
+	}
+	data, err := bson.Marshal(filter)
+	if err != nil {
+		return "?"
+	}
+	elems, err := bson.Raw(data).Elements()
+	if err != nil {
+		return "?"
+	}
+	keys := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		keys = append(keys, elem.Key())
+	}
+	return "{" + strings.Join(keys, ",") + "}"
+}
+
+func (collection *dbCollection) start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		semconv.DBSystemMongoDB,
+		semconv.DBOperationName(operation),
+		semconv.DBCollectionName(collection.name),
+	)
+	return tracer().Start(ctx, "db."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+}
+
+func end(span trace.Span, err error) {
+	// missing and duplicate documents are regular outcomes, not failures
+	if err != nil && err != db_interface.ErrNoDocuments && err != db_interface.ErrDuplicateKey {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// dbCollection methods
+
+func (collection *dbCollection) InsertOne(ctx context.Context, doc any) (id string, err error) {
+	ctx, span := collection.start(ctx, "InsertOne")
+	defer func() { end(span, err) }()
+	return collection.next.InsertOne(ctx, doc)
+}
+
+func (collection *dbCollection) FindOne(ctx context.Context, filter any, result any) (err error) {
+	ctx, span := collection.start(ctx, "FindOne", filterShapeKey.String(filterShape(filter)))
+	defer func() { end(span, err) }()
+	return collection.next.FindOne(ctx, filter, result)
+}
+
+func (collection *dbCollection) UpdateOne(ctx context.Context, filter any, update_with any) (err error) {
+	ctx, span := collection.start(ctx, "UpdateOne", filterShapeKey.String(filterShape(filter)))
+	defer func() { end(span, err) }()
+	return collection.next.UpdateOne(ctx, filter, update_with)
+}
+
+func (collection *dbCollection) ReplaceOne(ctx context.Context, filter any, replacement any) (err error) {
+	ctx, span := collection.start(ctx, "ReplaceOne", filterShapeKey.String(filterShape(filter)))
+	defer func() { end(span, err) }()
+	return collection.next.ReplaceOne(ctx, filter, replacement)
+}
+
+func (collection *dbCollection) DeleteOne(ctx context.Context, filter any) (err error) {
+	ctx, span := collection.start(ctx, "DeleteOne", filterShapeKey.String(filterShape(filter)))
+	defer func() { end(span, err) }()
+	return collection.next.DeleteOne(ctx, filter)
+}
+
+func (collection *dbCollection) FindSome(ctx context.Context, filter any, limit int, results any) (err error) {
+	ctx, span := collection.start(ctx, "FindSome",
+		filterShapeKey.String(filterShape(filter)),
+		attribute.Int("db.limit", limit))
+	defer func() { end(span, err) }()
+	return collection.next.FindSome(ctx, filter, limit, results)
+}
+
+func (collection *dbCollection) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, results any) (err error) {
+	ctx, span := collection.start(ctx, "FindSorted",
+		filterShapeKey.String(filterShape(filter)),
+		attribute.String("db.sort", sort),
+		attribute.Int("db.skip", skip),
+		attribute.Int("db.limit", limit))
+	defer func() { end(span, err) }()
+	return collection.next.FindSorted(ctx, filter, sort, skip, limit, results)
+}
+
+// query text isn't recorded, it's user input
+func (collection *dbCollection) Search(ctx context.Context, query string, filter any, limit int, results any) (err error) {
+	ctx, span := collection.start(ctx, "Search",
+		filterShapeKey.String(filterShape(filter)),
+		attribute.Int("db.limit", limit))
+	defer func() { end(span, err) }()
+	return collection.next.Search(ctx, query, filter, limit, results)
+}
+
+func (collection *dbCollection) IncrementOne(ctx context.Context, filter any, field string, by int) (err error) {
+	ctx, span := collection.start(ctx, "IncrementOne",
+		filterShapeKey.String(filterShape(filter)),
+		attribute.String("db.field", field))
+	defer func() { end(span, err) }()
+	return collection.next.IncrementOne(ctx, filter, field, by)
+}
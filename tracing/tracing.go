@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "url-shortener"
+
+const serviceName = "url-shortener"
+
+// helpers
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+func newExporter(ctx context.Context, exporter string, endpoint string) (sdktrace.SpanExporter, error) {
+	switch exporter {
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+}
+
+// functions
+
+// installs global tracer provider and W3C propagators
+// exporter is one of none, stdout or otlp; endpoint is an optional OTLP/HTTP url
+// (otherwise OTEL_EXPORTER_OTLP_* variables apply)
+// returned function flushes pending spans and should be called upon exit
+func Setup(ctx context.Context, exporter string, endpoint string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if exporter == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := newExporter(ctx, exporter, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return Install(sdktrace.WithBatcher(exp)), nil
+}
+
+// installs global tracer provider with given span processors (e.g. to test with an in-memory exporter)
+func Install(opts ...sdktrace.TracerProviderOption) (shutdown func(context.Context) error) {
+	res := resource.NewSchemaless(semconv.ServiceName(serviceName))
+	provider := sdktrace.NewTracerProvider(append([]sdktrace.TracerProviderOption{sdktrace.WithResource(res)}, opts...)...)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// response writer which remembers the status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// method of span name, arbitrary methods sent by clients are named OTHER
+func methodOf(r *http.Request) string {
+	switch r.Method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return r.Method
+	}
+	return "OTHER"
+}
+
+// middleware starting a server span per request
+// incoming W3C trace context (traceparent header) becomes the parent
+// route maps a request to a low-cardinality route label used as span name
+func Middleware(route func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		rt := route(r)
+		ctx, span := tracer().Start(ctx, fmt.Sprintf("%s %s", methodOf(r), rt),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(methodOf(r)),
+				semconv.HTTPRoute(rt),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+		// let clients correlate their requests with our traces
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"url-shortener/db_interface"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// stub collection
+type collectionStub struct{}
+
+func (collectionStub) InsertOne(ctx context.Context, doc any) (string, error) { return "1", nil }
+func (collectionStub) FindOne(ctx context.Context, filter any, result any) error {
+	return db_interface.ErrNoDocuments
+}
+func (collectionStub) UpdateOne(ctx context.Context, filter any, update_with any) error { return nil }
+func (collectionStub) ReplaceOne(ctx context.Context, filter any, replacement any) error {
+	return nil
+}
+func (collectionStub) DeleteOne(ctx context.Context, filter any) error { return nil }
+func (collectionStub) FindSome(ctx context.Context, filter any, limit int, results any) error {
+	return nil
+}
+func (collectionStub) FindSorted(ctx context.Context, filter any, sort string, skip int, limit int, results any) error {
+	return nil
+}
+func (collectionStub) IncrementOne(ctx context.Context, filter any, field string, by int) error {
+	return nil
+}
+func (collectionStub) Search(ctx context.Context, query string, filter any, limit int, results any) error {
+	return nil
+}
+
+type filterStub struct {
+	URL       string `bson:"url,omitempty"`
+	ShortCode string `bson:"shortCode,omitempty"`
+}
+
+// in-process collector
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	shutdown := Install(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { shutdown(context.Background()) })
+	return recorder
+}
+
+func TestSpans(t *testing.T) {
+	recorder := setupRecorder(t)
+	db := InstrumentDB(collectionStub{}, "urls")
+	route := func(r *http.Request) string { return "/shorten/{code}" }
+	handler := Middleware(route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db.FindOne(r.Context(), filterStub{ShortCode: "abc123"}, &filterStub{})
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("GET", "/shorten/abc123", nil)
+	req.Header.Set("traceparent", parent)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	db_span, server_span := spans[0], spans[1]
+	if server_span.Name() != "GET /shorten/{code}" || server_span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("invalid server span %s", server_span.Name())
+	}
+	if server_span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("incoming trace context wasn't propagated")
+	}
+	if db_span.Name() != "db.FindOne" || db_span.Parent().SpanID() != server_span.SpanContext().SpanID() {
+		t.Errorf("db span %s isn't a child of server span", db_span.Name())
+	}
+	found := false
+	for _, attr := range db_span.Attributes() {
+		if attr.Key == filterShapeKey {
+			found = true
+			if attr.Value.AsString() != "{shortCode}" {
+				t.Errorf("invalid filter shape %s", attr.Value.AsString())
+			}
+		}
+	}
+	if !found {
+		t.Error("filter shape wasn't recorded")
+	}
+	if w.Header().Get("traceparent") == "" {
+		t.Error("trace context wasn't returned")
+	}
+}
+
+func TestSpanNameOfUnknownMethod(t *testing.T) {
+	recorder := setupRecorder(t)
+	route := func(r *http.Request) string { return "/shorten/{code}" }
+	handler := Middleware(route, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("FOO123", "/shorten/abc123", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "OTHER /shorten/{code}" {
+		t.Errorf("invalid spans %v", spans)
+	}
+}
@@ -15,23 +15,285 @@ type URLData struct {
 	ID        string `json:"_id,omitempty" bson:"_id,omitempty"`
 	URL       string `json:"url" bson:"url,omitempty"` // json.url cannot be empty
 	ShortCode string `json:"shortCode,omitempty" bson:"shortCode,omitempty"`
+	Title     string `json:"title,omitempty" bson:"title,omitempty"`
+	// short domain the code belongs to, codes are unique per domain
+	// empty for the default domain (and records stored before domains were introduced)
+	Domain string `json:"domain,omitempty" bson:"domain,omitempty"`
+	// full short url and api urls of the record, computed for responses
+	ShortURL string `json:"shortUrl,omitempty" bson:"-"`
+	Links    *Links `json:"links,omitempty" bson:"-"`
+	// workspace owning the link and user who created it, empty while multi-tenancy is off
+	Workspace string `json:"workspace,omitempty" bson:"workspace,omitempty"`
+	Owner     string `json:"owner,omitempty" bson:"owner,omitempty"`
+	// short code was chosen by the creator rather than generated
+	Alias bool `json:"alias,omitempty" bson:"alias,omitempty"`
+	// user-defined labels to organize links
+	Description string   `json:"description,omitempty" bson:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	Folder      string   `json:"folder,omitempty" bson:"folder,omitempty"`
+	// name of marketing campaign the link belongs to
+	Campaign string `json:"campaign,omitempty" bson:"campaign,omitempty"`
+	// utm parameters received via json (without utm_ prefix), merged into url
+	UTM map[string]string `json:"-" bson:"-"`
+	// host of url, stored for searching
+	Host string `json:"-" bson:"host,omitempty"`
+	// always show a warning page before redirecting
+	Interstitial bool `json:"interstitial,omitempty" bson:"interstitial,omitempty"`
+	// resolvable only via signed, time-limited links
+	SignedOnly bool `json:"signedOnly,omitempty" bson:"signedOnly,omitempty"`
+	// append path suffix (/{code}/more/path) and/or query of the short url to the destination
+	PassPath  bool `json:"passPath,omitempty" bson:"passPath,omitempty"`
+	PassQuery bool `json:"passQuery,omitempty" bson:"passQuery,omitempty"`
+	// which value wins when passed query repeats a destination parameter, see Query* constants
+	QueryConflict string `json:"queryConflict,omitempty" bson:"queryConflict,omitempty"`
+	// alternative destinations, the first matching rule wins, url is the fallback
+	Rules []Rule `json:"rules,omitempty" bson:"rules,omitempty"`
+	// weighted destinations replacing url for clients matched by no rule (A/B split)
+	// sticky variants are remembered in a cookie, so returning clients get the same one
+	Variants       []Variant `json:"variants,omitempty" bson:"variants,omitempty"`
+	StickyVariants bool      `json:"stickyVariants,omitempty" bson:"stickyVariants,omitempty"`
+	// bcrypt hash of link password, never leaves the server
+	PasswordHash string `json:"-" bson:"passwordHash,omitempty"`
+	// plain password received via json, write-only
+	Password string `json:"-" bson:"-"`
+	// set instead of the password hash in audit snapshots
+	HasPassword bool `json:"-" bson:"hasPassword,omitempty"`
 	// custom-marshaled propeties
 	CreatedAt   time.Time `json:"-" bson:"createdAt,omitempty"`
 	UpdatedAt   time.Time `json:"-" bson:"updatedAt,omitempty"`
 	AccessCount int       `json:"-" bson:"accessCount,omitempty"`
+	// clicks by variant name, part of access count
+	VariantClicks map[string]int `json:"-" bson:"variantClicks,omitempty"`
+	// bumped on every change, used for optimistic concurrency
+	Version int `json:"version,omitempty" bson:"version,omitempty"`
+	// soft deletion state, output only
+	Deleted   bool      `json:"-" bson:"deleted,omitempty"`
+	DeletedAt time.Time `json:"-" bson:"deletedAt,omitempty"`
 	// control properties
 	include_access_count_in_json bool `json:"-" bson:"-"`
 }
 
+// user editable part of a record, used to update it in place
+// no omitempty here, cleared values have to be cleared in the db too
+type EditableData struct {
+	URL            string    `bson:"url"`
+	Host           string    `bson:"host"`
+	Title          string    `bson:"title"`
+	Description    string    `bson:"description"`
+	Tags           []string  `bson:"tags"`
+	Folder         string    `bson:"folder"`
+	Campaign       string    `bson:"campaign"`
+	Interstitial   bool      `bson:"interstitial"`
+	SignedOnly     bool      `bson:"signedOnly"`
+	PassPath       bool      `bson:"passPath"`
+	PassQuery      bool      `bson:"passQuery"`
+	QueryConflict  string    `bson:"queryConflict"`
+	Rules          []Rule    `bson:"rules"`
+	Variants       []Variant `bson:"variants"`
+	StickyVariants bool      `bson:"stickyVariants"`
+	PasswordHash   *string   `bson:"passwordHash"` // nil removes the password, like on records which never had one
+	UpdatedAt      time.Time `bson:"updatedAt"`
+	Version        int       `bson:"version"`
+}
+
+// hypermedia links of a record
+type Links struct {
+	Self    string `json:"self"`
+	Stats   string `json:"stats"`
+	QR      string `json:"qr"`
+	History string `json:"history"`
+}
+
+// routing rule, matches when all of its set conditions match
+// values of a condition are alternatives
+type Rule struct {
+	Platforms []string   `json:"platforms,omitempty" bson:"platforms,omitempty"` // see Platform* constants
+	Languages []string   `json:"languages,omitempty" bson:"languages,omitempty"` // Accept-Language tags, "de" matches "de-AT" too
+	Countries []string   `json:"countries,omitempty" bson:"countries,omitempty"` // ISO 3166 codes, resolved from client ip
+	From      *time.Time `json:"from,omitempty" bson:"from,omitempty"`           // time window, both ends optional
+	Until     *time.Time `json:"until,omitempty" bson:"until,omitempty"`
+	URL       string     `json:"url" bson:"url"`
+}
+
+// weighted destination, picked with probability weight / sum of weights
+type Variant struct {
+	Name   string `json:"name" bson:"name"` // defaults to a, b, c...
+	URL    string `json:"url" bson:"url"`
+	Weight int    `json:"weight" bson:"weight"` // defaults to 1
+}
+
+// client platforms
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformDesktop = "desktop"
+)
+
+// query conflict rules
+const (
+	QueryKeepDestination = "destination" // drop passed parameter (default)
+	QueryOverride        = "incoming"    // passed parameter replaces destination one
+	QueryAppend          = "append"      // keep both
+)
+
+// relative weights of searchable fields (bson names)
+var SearchWeights = map[string]int{
+	"title": 10,
+	"tags":  5,
+	"host":  3,
+	"url":   1,
+}
+
+// filter matching the record of a short code on a domain, and of a version if set
+// records of the default domain have no domain field, matched by null
+type CodeFilter struct {
+	Domain    *string `bson:"domain"` // nil for the default domain
+	ShortCode string  `bson:"shortCode"`
+	Version   int     `bson:"version,omitempty"`
+}
+
+// filter of short code on domain, empty domain is the default one
+func ByCode(domain string, short_code string) CodeFilter {
+	filter := CodeFilter{ShortCode: short_code}
+	if domain != "" {
+		filter.Domain = &domain
+	}
+	return filter
+}
+
+// domain of filter, empty for the default one
+func (f CodeFilter) DomainName() string {
+	if f.Domain == nil {
+		return ""
+	}
+	return *f.Domain
+}
+
+// filter of an existing record a new one without options can be shared with, on the same domain and in the same workspace
+// set labels have to match, records with options, protected and deleted records are left out
+type DuplicateFilter struct {
+	URL            string   `bson:"url"`
+	Title          string   `bson:"title,omitempty"`
+	Description    string   `bson:"description,omitempty"`
+	Tags           []string `bson:"tags,omitempty"`
+	Folder         string   `bson:"folder,omitempty"`
+	Campaign       string   `bson:"campaign,omitempty"`
+	Owner          string   `bson:"owner,omitempty"`
+	Domain         *string  `bson:"domain"`       // nil for the default domain
+	Workspace      *string  `bson:"workspace"`    // nil while multi-tenancy is off
+	PasswordHash   *string  `bson:"passwordHash"` // always nil
+	Deleted        *Cmp     `bson:"deleted"`
+	Interstitial   *Cmp     `bson:"interstitial"`
+	SignedOnly     *Cmp     `bson:"signedOnly"`
+	PassPath       *Cmp     `bson:"passPath"`
+	PassQuery      *Cmp     `bson:"passQuery"`
+	StickyVariants *Cmp     `bson:"stickyVariants"`
+	Rules          *Cmp     `bson:"rules.0"` // no first rule, rules are missing or empty
+	Variants       *Cmp     `bson:"variants.0"`
+}
+
+// filter of records the new record can be shared with, which mustn't have options either
+func DuplicateOf(record URLData) DuplicateFilter {
+	filter := DuplicateFilter{
+		URL:            record.URL,
+		Title:          record.Title,
+		Description:    record.Description,
+		Tags:           record.Tags,
+		Folder:         record.Folder,
+		Campaign:       record.Campaign,
+		Owner:          record.Owner,
+		Deleted:        NotDeleted(),
+		Interstitial:   &Cmp{Ne: true},
+		SignedOnly:     &Cmp{Ne: true},
+		PassPath:       &Cmp{Ne: true},
+		PassQuery:      &Cmp{Ne: true},
+		StickyVariants: &Cmp{Ne: true},
+		Rules:          Missing(),
+		Variants:       Missing(),
+	}
+	if record.Domain != "" {
+		filter.Domain = &record.Domain
+	}
+	if record.Workspace != "" {
+		filter.Workspace = &record.Workspace
+	}
+	return filter
+}
+
+// fields changed when a deleted record is restored, nil fields are removed
+type RestoreData struct {
+	Deleted   *bool      `bson:"deleted"`
+	DeletedAt *time.Time `bson:"deletedAt"`
+	UpdatedAt time.Time  `bson:"updatedAt"`
+	Version   int        `bson:"version"`
+}
+
+// comparison of a filter field
+type Cmp struct {
+	Ne     any   `bson:"$ne,omitempty"`
+	Lt     any   `bson:"$lt,omitempty"`
+	Exists *bool `bson:"$exists,omitempty"`
+}
+
+// condition of fields which don't exist
+func Missing() *Cmp {
+	exists := false
+	return &Cmp{Exists: &exists}
+}
+
+// condition of records which aren't deleted, deleted is missing or false
+func NotDeleted() *Cmp {
+	return &Cmp{Ne: true}
+}
+
+// list filter, matches records having the tag and/or stored in the folder or belonging to the campaign (of the workspace)
+type ListFilter struct {
+	Workspace string `bson:"workspace,omitempty"`
+	Tag       string `bson:"tags,omitempty"` // matches any element of tags
+	Folder    string `bson:"folder,omitempty"`
+	Campaign  string `bson:"campaign,omitempty"`
+	Deleted   *Cmp   `bson:"deleted,omitempty"` // NotDeleted() to leave deleted records out
+}
+
+// filter of records deleted before a point in time
+type DeletedFilter struct {
+	Deleted   bool `bson:"deleted"`
+	DeletedAt Cmp  `bson:"deletedAt"`
+}
+
+func DeletedBefore(t time.Time) DeletedFilter {
+	return DeletedFilter{Deleted: true, DeletedAt: Cmp{Lt: t}}
+}
+
+// filter of the record of a short code on a domain, as long as it's still deleted before a point in time
+type PurgeFilter struct {
+	Domain        *string `bson:"domain"` // nil for the default domain
+	ShortCode     string  `bson:"shortCode"`
+	DeletedFilter `bson:",inline"`
+}
+
+func PurgeOf(domain string, short_code string, t time.Time) PurgeFilter {
+	filter := PurgeFilter{ShortCode: short_code, DeletedFilter: DeletedBefore(t)}
+	if domain != "" {
+		filter.Domain = &domain
+	}
+	return filter
+}
+
 // alias to avoid recursion during marshal/unmarshal
 type urlDataAlias URLData
 
 // auxiliary type for marshal/unmarshal (doesn't have MarshalJSON/UnmarshalJSON methods)
 type urlDataAux struct {
-	*urlDataAlias        // embed all fields from URLData
-	CreatedAt     string `json:"createdAt,omitempty"`   // shadowed
-	UpdatedAt     string `json:"updatedAt,omitempty"`   // shadowed
-	AccessCount   *int   `json:"accessCount,omitempty"` // use pointer, json handles them gracefully
+	*urlDataAlias                   // embed all fields from URLData
+	CreatedAt     string            `json:"createdAt,omitempty"`     // shadowed
+	UpdatedAt     string            `json:"updatedAt,omitempty"`     // shadowed
+	AccessCount   *int              `json:"accessCount,omitempty"`   // use pointer, json handles them gracefully
+	VariantClicks map[string]int    `json:"variantClicks,omitempty"` // output only, along with access count
+	Password      string            `json:"password,omitempty"`      // input only
+	UTM           map[string]string `json:"utm,omitempty"`           // input only
+	Protected     bool              `json:"protected,omitempty"`     // output only
+	DeletedAt     string            `json:"deletedAt,omitempty"`     // output only
 }
 
 // controls whether to include access count in json or not
@@ -39,6 +301,63 @@ func (u *URLData) IncludeAccessCountInJSON(include bool) {
 	u.include_access_count_in_json = include
 }
 
+// editable fields of the record
+func (u *URLData) Editable() EditableData {
+	changes := EditableData{
+		URL:            u.URL,
+		Host:           u.Host,
+		Title:          u.Title,
+		Description:    u.Description,
+		Tags:           u.Tags,
+		Folder:         u.Folder,
+		Campaign:       u.Campaign,
+		Interstitial:   u.Interstitial,
+		SignedOnly:     u.SignedOnly,
+		PassPath:       u.PassPath,
+		PassQuery:      u.PassQuery,
+		QueryConflict:  u.QueryConflict,
+		Rules:          u.Rules,
+		Variants:       u.Variants,
+		StickyVariants: u.StickyVariants,
+		UpdatedAt:      u.UpdatedAt,
+		Version:        u.Version,
+	}
+	if u.PasswordHash != "" {
+		changes.PasswordHash = &u.PasswordHash
+	}
+	return changes
+}
+
+// whether the record needs a password to be resolved
+func (u *URLData) IsProtected() bool {
+	return u.PasswordHash != "" || u.HasPassword
+}
+
+// whether the record changes how it's resolved, by rules, variants, passthrough, interstitial or signatures
+func (u *URLData) HasOptions() bool {
+	return u.Interstitial || u.SignedOnly || u.PassPath || u.PassQuery || u.StickyVariants ||
+		len(u.Rules) > 0 || len(u.Variants) > 0
+}
+
+// hide destinations of protected and signed-only records, for responses which don't check password or signature
+func (u *URLData) Redact() {
+	if !u.IsProtected() && !u.SignedOnly {
+		return
+	}
+	u.URL = ""
+	u.Host = ""
+	u.Rules = nil
+	u.Variants = nil
+}
+
+// copy of the record without its password hash
+func (u *URLData) Snapshot() *URLData {
+	s := *u
+	s.HasPassword = u.IsProtected()
+	s.PasswordHash = ""
+	return &s
+}
+
 // json marshaler (convert to []byte)
 func (u *URLData) MarshalJSON() ([]byte, error) {
 
@@ -51,6 +370,13 @@ func (u *URLData) MarshalJSON() ([]byte, error) {
 		CreatedAt:    u.CreatedAt.Format(time.RFC3339),
 		UpdatedAt:    u.UpdatedAt.Format(time.RFC3339),
 		AccessCount:  ac_val,
+		Protected:    u.IsProtected(),
+	}
+	if u.include_access_count_in_json {
+		aux.VariantClicks = u.VariantClicks
+	}
+	if u.Deleted {
+		aux.DeletedAt = u.DeletedAt.Format(time.RFC3339)
 	}
 	return json.Marshal(aux)
 }
@@ -70,6 +396,8 @@ func (u *URLData) UnmarshalJSON(data []byte) error {
 	if aux.AccessCount != nil {
 		u.AccessCount = *aux.AccessCount
 	}
+	u.Password = aux.Password
+	u.UTM = aux.UTM
 	// check if url is empty
 	if u.URL == "" {
 		return fmt.Errorf("missing required field url")
@@ -0,0 +1,105 @@
+package url_signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minimal secret length in bytes
+const MinSecretLen int = 16
+
+var ErrInvalidSignature = errors.New("invalid signature")
+var ErrExpired = errors.New("link expired")
+
+// HMAC-SHA256 signer of time-limited short links
+// signatures look like <key id>.<base64url mac>, so that keys can be rotated:
+// new links are signed with the active key, any known key verifies
+type Signer struct {
+	keys   map[string][]byte // key id -> secret
+	active string
+}
+
+// helpers
+
+func mac(secret []byte, short_code string, expires int64) []byte {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s\n%d", short_code, expires)
+	return h.Sum(nil)
+}
+
+// functions
+
+// create signer, active is the id of the key used for new signatures
+func New(keys map[string][]byte, active string) (*Signer, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("unknown active key %q", active)
+	}
+	for id, secret := range keys {
+		if id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(secret) < MinSecretLen {
+			return nil, fmt.Errorf("secret of key %q is shorter than %d bytes", id, MinSecretLen)
+		}
+	}
+	return &Signer{keys: keys, active: active}, nil
+}
+
+// parse keys like "id1:secret1,id2:secret2", first key is active
+func Parse(spec string) (*Signer, error) {
+	keys := make(map[string][]byte)
+	active := ""
+	for _, pair := range strings.Split(spec, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid key %q, expected id:secret", pair)
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		keys[id] = []byte(secret)
+		if active == "" {
+			active = id
+		}
+	}
+	return New(keys, active)
+}
+
+// Signer methods
+
+// sign short code until expires
+func (s *Signer) Sign(short_code string, expires time.Time) string {
+	sum := mac(s.keys[s.active], short_code, expires.Unix())
+	return s.active + "." + base64.RawURLEncoding.EncodeToString(sum)
+}
+
+// verify signature of short code, expires is unix time
+func (s *Signer) Verify(short_code string, expires string, sig string, now time.Time) error {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	id, encoded, ok := strings.Cut(sig, ".")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	secret, ok := s.keys[id]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal(sum, mac(secret, short_code, exp)) {
+		return ErrInvalidSignature
+	}
+	// check expiry only for authentic links
+	if now.Unix() >= exp {
+		return ErrExpired
+	}
+	return nil
+}
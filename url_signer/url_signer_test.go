@@ -0,0 +1,53 @@
+package url_signer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	signer, err := Parse("k2:0123456789abcdef0123,k1:fedcba9876543210fedc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	sig := signer.Sign("abc123", expires)
+
+	if err := signer.Verify("abc123", exp, sig, now); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if err := signer.Verify("abc124", exp, sig, now); err != ErrInvalidSignature {
+		t.Errorf("signature of other code accepted: %v", err)
+	}
+	if err := signer.Verify("abc123", exp+"0", sig, now); err != ErrInvalidSignature {
+		t.Errorf("tampered expiry accepted: %v", err)
+	}
+	if err := signer.Verify("abc123", exp, sig, expires); err != ErrExpired {
+		t.Errorf("expired link accepted: %v", err)
+	}
+
+	// rotation: links signed with the old key keep working
+	rotated, err := Parse("k3:00112233445566778899,k2:0123456789abcdef0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotated.Verify("abc123", exp, sig, now); err != nil {
+		t.Errorf("rotated signer rejected old key: %v", err)
+	}
+	// retired key
+	retired, _ := Parse("k3:00112233445566778899")
+	if err := retired.Verify("abc123", exp, sig, now); err != ErrInvalidSignature {
+		t.Errorf("retired key accepted: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"", "k1", "k1:short", "k.1:0123456789abcdef", "k1:0123456789abcdef,k1:0123456789abcdef"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("invalid spec %q accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package workspace
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// workspace names appear in urls and records
+var nameFormat = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// api keys start with it, so that leaked keys are easy to spot
+const keyPrefix = "usk_"
+
+// number of token characters kept to tell keys apart
+const keyHintLen = 8
+
+// bcrypt ignores everything past 72 bytes
+const minPasswordLen = 8
+const maxPasswordLen = 72
+
+var ErrInvalidName = errors.New("workspace name must be 1-64 lowercase letters, digits, '.', '_' or '-'")
+var ErrInvalidUserName = errors.New("user name must be 1-64 lowercase letters, digits, '.', '_' or '-'")
+var ErrInvalidPassword = fmt.Errorf("password must be %d-%d bytes long", minPasswordLen, maxPasswordLen)
+
+// tenant owning links, api keys and users, stored in its own collection
+// records refer to it by name
+// omitempty is required for db filters
+type Workspace struct {
+	ID         string    `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name       string    `json:"name" bson:"name,omitempty"`
+	Domain     string    `json:"domain,omitempty" bson:"domain,omitempty"` // custom short domain, reserved to the workspace
+	Quotas     Quotas    `json:"quotas" bson:"quotas,omitempty"`
+	UserQuotas Quotas    `json:"userQuotas" bson:"userQuotas,omitempty"` // limits of each user, on top of the workspace ones
+	CreatedAt  time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+}
+
+// limits of a workspace, zero means unlimited
+type Quotas struct {
+	MaxLinks     int `json:"maxLinks,omitempty" bson:"maxLinks,omitempty"`         // active (not deleted) links
+	MonthlyLinks int `json:"monthlyLinks,omitempty" bson:"monthlyLinks,omitempty"` // links created per calendar month
+	MaxAliases   int `json:"maxAliases,omitempty" bson:"maxAliases,omitempty"`     // active links with custom short codes
+}
+
+// usage counters of a workspace or of a user in it, kept up to date along with links
+// omitempty is required for db filters
+type Usage struct {
+	ID      string         `json:"-" bson:"_id,omitempty"`
+	Key     string         `json:"-" bson:"key,omitempty"` // see UsageKey
+	Links   int            `json:"links" bson:"links,omitempty"`
+	Aliases int            `json:"aliases" bson:"aliases,omitempty"`
+	Monthly map[string]int `json:"monthly,omitempty" bson:"monthly,omitempty"` // links created by month, see Month
+}
+
+// quota a usage counter is limited by, reported when it's exceeded
+type Limit struct {
+	Quota string `json:"quota"` // name of the Quotas field
+	Max   int    `json:"max"`
+	Used  int    `json:"used"`
+}
+
+// api key of a workspace, only the hash of the token is stored
+// omitempty is required for db filters
+type APIKey struct {
+	ID        string    `json:"_id,omitempty" bson:"_id,omitempty"`
+	Workspace string    `json:"workspace" bson:"workspace,omitempty"`
+	User      string    `json:"user" bson:"user,omitempty"`           // who the key was issued to
+	Name      string    `json:"name,omitempty" bson:"name,omitempty"` // what the key is used for
+	Hint      string    `json:"hint" bson:"hint,omitempty"`           // start of the token
+	Hash      string    `json:"-" bson:"hash,omitempty"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+}
+
+// account of a user of a workspace, signing in to the web frontend
+// omitempty is required for db filters
+type User struct {
+	ID           string    `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name         string    `json:"name" bson:"name,omitempty"` // unique across workspaces
+	Workspace    string    `json:"workspace" bson:"workspace,omitempty"`
+	PasswordHash string    `json:"-" bson:"passwordHash,omitempty"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt,omitempty"`
+}
+
+// signed in browser of a user, only the hash of its token (kept in a cookie) is stored
+// the csrf token has to accompany changes made within the session
+// omitempty is required for db filters
+type Session struct {
+	ID        string    `json:"-" bson:"_id,omitempty"`
+	Hash      string    `json:"-" bson:"hash,omitempty"`
+	User      string    `json:"user" bson:"user,omitempty"`
+	Workspace string    `json:"workspace" bson:"workspace,omitempty"`
+	CSRFToken string    `json:"csrfToken" bson:"csrfToken,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt,omitempty"`
+}
+
+// functions
+
+// random url-safe token
+func randomToken() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// check name and normalize domain
+func (w *Workspace) Normalize() error {
+	w.Name = strings.TrimSpace(w.Name)
+	if !nameFormat.MatchString(w.Name) {
+		return ErrInvalidName
+	}
+	w.Domain = strings.ToLower(strings.TrimSpace(w.Domain))
+	for _, q := range []Quotas{w.Quotas, w.UserQuotas} {
+		if q.MaxLinks < 0 || q.MonthlyLinks < 0 || q.MaxAliases < 0 {
+			return errors.New("quotas can't be negative")
+		}
+	}
+	return nil
+}
+
+// key of the usage counters of workspace, or of a user in it
+func UsageKey(workspace string, user string) string {
+	if user == "" {
+		return workspace
+	}
+	return workspace + "/" + user
+}
+
+// key of monthly counters
+func Month(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// limits of quotas exceeded by usage in month, nil if none
+func (q Quotas) Exceeded(u Usage, month string) []Limit {
+	var exceeded []Limit
+	check := func(quota string, max int, used int) {
+		if max > 0 && used > max {
+			exceeded = append(exceeded, Limit{Quota: quota, Max: max, Used: used})
+		}
+	}
+	check("maxLinks", q.MaxLinks, u.Links)
+	check("monthlyLinks", q.MonthlyLinks, u.Monthly[month])
+	check("maxAliases", q.MaxAliases, u.Aliases)
+	return exceeded
+}
+
+// create key of user in workspace
+// returns the key to store and its token, which is shown only once
+func NewKey(workspace string, user string, name string) (APIKey, string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	token := keyPrefix + secret
+	key := APIKey{
+		Workspace: workspace,
+		User:      user,
+		Name:      name,
+		Hint:      token[:len(keyPrefix)+keyHintLen],
+		Hash:      HashToken(token),
+		CreatedAt: time.Now().UTC(),
+	}
+	return key, token, nil
+}
+
+// stored hash of token
+// tokens are random, so a fast hash is enough and allows looking keys up by it
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// check name and password of new account
+func (u *User) Normalize(password string) error {
+	u.Name = strings.TrimSpace(u.Name)
+	if !nameFormat.MatchString(u.Name) {
+		return ErrInvalidUserName
+	}
+	if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// create session of user valid for ttl
+// returns the session to store and its token, which goes into the cookie
+func NewSession(user User, ttl time.Duration) (Session, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+	session := Session{
+		Hash:      HashToken(token),
+		User:      user.Name,
+		Workspace: user.Workspace,
+		CSRFToken: csrf,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+	return session, token, nil
+}
@@ -0,0 +1,101 @@
+package workspace
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	w := Workspace{Name: " acme ", Domain: " Acme.Link "}
+	if err := w.Normalize(); err != nil || w.Name != "acme" || w.Domain != "acme.link" {
+		t.Errorf("invalid workspace %+v %v", w, err)
+	}
+	for _, name := range []string{"", "Acme", "a/b", "-acme", strings.Repeat("a", 65)} {
+		w := Workspace{Name: name}
+		if err := w.Normalize(); err == nil {
+			t.Errorf("invalid name %q accepted", name)
+		}
+	}
+	for _, w := range []Workspace{{Name: "acme", Quotas: Quotas{MaxLinks: -1}}, {Name: "acme", UserQuotas: Quotas{MaxAliases: -1}}} {
+		if err := w.Normalize(); err == nil {
+			t.Error("negative quota accepted")
+		}
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	key, token, err := NewKey("acme", "alice", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, keyPrefix) || !strings.HasPrefix(token, key.Hint) || len(key.Hint) != len(keyPrefix)+keyHintLen {
+		t.Errorf("invalid token %s hint %s", token, key.Hint)
+	}
+	if key.Hash != HashToken(token) || strings.Contains(key.Hash, token) {
+		t.Errorf("invalid hash %s", key.Hash)
+	}
+	if key.Workspace != "acme" || key.User != "alice" || key.Name != "ci" {
+		t.Errorf("invalid key %+v", key)
+	}
+	_, other, _ := NewKey("acme", "alice", "ci")
+	if other == token {
+		t.Error("tokens should be random")
+	}
+}
+
+func TestExceeded(t *testing.T) {
+	month := Month(time.Date(2024, 11, 29, 0, 0, 0, 0, time.UTC))
+	if month != "2024-11" {
+		t.Errorf("invalid month %s", month)
+	}
+	usage := Usage{Links: 3, Aliases: 1, Monthly: map[string]int{"2024-10": 9, month: 3}}
+	if exceeded := (Quotas{}).Exceeded(usage, month); exceeded != nil {
+		t.Errorf("unlimited quotas exceeded %+v", exceeded)
+	}
+	if exceeded := (Quotas{MaxLinks: 3, MonthlyLinks: 5, MaxAliases: 1}).Exceeded(usage, month); exceeded != nil {
+		t.Errorf("quotas exceeded %+v", exceeded)
+	}
+	exceeded := Quotas{MaxLinks: 2, MonthlyLinks: 5}.Exceeded(usage, month)
+	if len(exceeded) != 1 || exceeded[0] != (Limit{Quota: "maxLinks", Max: 2, Used: 3}) {
+		t.Errorf("invalid limits %+v", exceeded)
+	}
+	exceeded = Quotas{MonthlyLinks: 2}.Exceeded(usage, month)
+	if len(exceeded) != 1 || exceeded[0].Quota != "monthlyLinks" {
+		t.Errorf("invalid limits %+v", exceeded)
+	}
+	if key := UsageKey("acme", "alice"); key != "acme/alice" || UsageKey("acme", "") != "acme" {
+		t.Errorf("invalid key %s", key)
+	}
+}
+
+func TestUserNormalize(t *testing.T) {
+	u := User{Name: " alice "}
+	if err := u.Normalize("correct horse"); err != nil || u.Name != "alice" {
+		t.Errorf("invalid user %+v %v", u, err)
+	}
+	for name, password := range map[string]string{
+		"Alice": "correct horse",
+		"":      "correct horse",
+		"bob":   "short",
+		"carol": strings.Repeat("x", 73),
+	} {
+		u := User{Name: name}
+		if err := u.Normalize(password); err == nil {
+			t.Errorf("invalid user %q accepted", name)
+		}
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	session, token, err := NewSession(User{Name: "alice", Workspace: "acme"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Hash != HashToken(token) || session.CSRFToken == "" || session.CSRFToken == token {
+		t.Errorf("invalid session %+v", session)
+	}
+	if session.User != "alice" || session.Workspace != "acme" || time.Until(session.ExpiresAt) <= 59*time.Minute {
+		t.Errorf("invalid session %+v", session)
+	}
+}